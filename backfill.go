@@ -0,0 +1,514 @@
+// mautrix-groupme - A Matrix-GroupMe puppeting bridge.
+// Copyright (C) 2022 Sumner Evans, Karmanyaah Malhotra
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/beeper/groupme-lib"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/groupme/database"
+	"github.com/beeper/groupme/groupmeext"
+)
+
+var (
+	PortalCreationDummyEvent = event.Type{Type: "fi.mau.dummy.portal_created", Class: event.MessageEventType}
+	HistorySyncMarker        = event.Type{Type: "org.matrix.msc2716.marker", Class: event.StateEventType}
+)
+
+const (
+	// likeReaction is the reaction that GroupMe likes are bridged as.
+	likeReaction = "❤"
+	// manualBackfillBatchSize is the maximum number of messages inserted in
+	// each batch by the backfill command.
+	manualBackfillBatchSize = 100
+	// batchSendRoomVersion is the room version portals are created with when
+	// backfilling is enabled. Synapse only creates the insertion events that
+	// chain batches together in rooms with this version.
+	batchSendRoomVersion = "org.matrix.msc2716v3"
+)
+
+// backfillResult describes how far a single backfill request got.
+type backfillResult struct {
+	// Oldest is the oldest message that was fetched, which is where the next
+	// request should continue from.
+	Oldest groupme.ID
+	// Count is the number of messages that were bridged.
+	Count int
+	// ReachedSince is set if the request stopped because it found messages
+	// older than the requested start time.
+	ReachedSince bool
+	// ReachedStart is set if there are no older messages on GroupMe.
+	ReachedStart bool
+}
+
+// initBackfill marks the start of a newly created portal, which is where
+// history is inserted with batch sending.
+func (portal *Portal) initBackfill() error {
+	resp, err := portal.MainIntent().SendMessageEvent(portal.MXID, PortalCreationDummyEvent, struct{}{})
+	if err != nil {
+		return fmt.Errorf("failed to send dummy event to mark portal creation: %w", err)
+	}
+	portal.FirstEventID = resp.EventID
+	portal.NextBatchID = ""
+	portal.Update(nil)
+	return nil
+}
+
+// backfillNewPortal queues backfilling a newly created portal, and fills it
+// with the immediate batch of recent messages right away. The deferred stages
+// are left to the backfill queue.
+func (portal *Portal) backfillNewPortal(source *User) {
+	if err := portal.initBackfill(); err != nil {
+		portal.log.Errorln("Failed to start backfill:", err)
+		return
+	}
+	immediate := portal.enqueueBackfills(source)
+	portal.bridge.BackfillQueue.RunNow(immediate)
+}
+
+// enqueueBackfills adds the immediate backfill and every deferred stage from
+// the config to the backfill queue, and returns the immediate one.
+func (portal *Portal) enqueueBackfills(source *User) *database.Backfill {
+	historySync := portal.bridge.Config.Bridge.HistorySync
+	immediate := portal.bridge.DB.Backfill.NewWithValues(source.MXID, portal.Key, database.BackfillImmediate, 0, nil,
+		historySync.Immediate.MaxEvents, 0, historySync.Immediate.MaxEvents)
+	immediate.Insert()
+	for i, stage := range historySync.Deferred {
+		var timeStart *time.Time
+		if stage.StartDaysAgo >= 0 {
+			ts := time.Now().AddDate(0, 0, -stage.StartDaysAgo)
+			timeStart = &ts
+		}
+		portal.bridge.DB.Backfill.NewWithValues(source.MXID, portal.Key, database.BackfillDeferred, 10+i, timeStart,
+			stage.MaxBatchEvents, stage.BatchDelay, 0).Insert()
+	}
+	return immediate
+}
+
+// oldestBackfilledMessage finds the oldest message any of the user's backfill
+// tasks in the portal have reached, or the oldest bridged message if that's
+// older, which is where the next backfill continues.
+func (portal *Portal) oldestBackfilledMessage(source *User) (oldest groupme.ID) {
+	if first := portal.bridge.DB.Message.GetFirstInChat(portal.Key); first != nil {
+		oldest = first.GMID
+	}
+	for _, task := range portal.bridge.DB.Backfill.GetAllForPortal(source.MXID, portal.Key) {
+		if len(task.OldestMessageID) > 0 && (len(oldest) == 0 || groupmeext.IsNewerMessageID(oldest, task.OldestMessageID)) {
+			oldest = task.OldestMessageID
+		}
+	}
+	return
+}
+
+// runBackfillTask backfills batches until the task is done. Progress is saved
+// after every batch, so the task can continue where it stopped after errors
+// and restarts.
+func (portal *Portal) runBackfillTask(source *User, task *database.Backfill) error {
+	if len(task.OldestMessageID) == 0 {
+		task.OldestMessageID = portal.oldestBackfilledMessage(source)
+	}
+	var since time.Time
+	if task.TimeStart != nil {
+		since = *task.TimeStart
+	}
+	for {
+		limit := task.MaxBatchEvents
+		if task.MaxTotalEvents > 0 && task.MaxTotalEvents-task.BackfilledCount < limit {
+			limit = task.MaxTotalEvents - task.BackfilledCount
+		}
+		if limit <= 0 {
+			task.MarkDone()
+			return nil
+		}
+		res, err := portal.backfill(source, task.OldestMessageID, limit, since)
+		if err != nil {
+			return err
+		}
+		portal.log.Debugfln("Backfilled %d messages before %s for %s", res.Count, task.OldestMessageID, source.MXID)
+		if len(res.Oldest) > 0 {
+			task.OldestMessageID = res.Oldest
+		}
+		task.BackfilledCount += res.Count
+		if res.ReachedStart {
+			task.MarkDone()
+			portal.bridge.DB.Backfill.CompleteAllForPortal(source.MXID, portal.Key)
+			portal.log.Infoln("Finished backfilling history for", source.MXID)
+			return nil
+		} else if res.ReachedSince {
+			task.MarkDone()
+			return nil
+		}
+		task.Update()
+		time.Sleep(time.Duration(task.BatchDelay) * time.Second)
+	}
+}
+
+// findBackfillStart makes sure the portal has an event to insert history
+// before. Portals that were created without backfilling use the creation event
+// of the room. History can only be inserted into rooms the bridge created with
+// the MSC2716 room version, as batches can't be chained in other rooms.
+func (portal *Portal) findBackfillStart() error {
+	var create event.CreateEventContent
+	err := portal.MainIntent().StateEvent(portal.MXID, event.StateCreate, "", &create)
+	if err != nil {
+		return fmt.Errorf("failed to get room create event: %w", err)
+	} else if create.RoomVersion != batchSendRoomVersion || create.Creator != portal.MainIntent().UserID {
+		return fmt.Errorf("history can't be inserted into rooms that weren't created by the bridge with room version %s", batchSendRoomVersion)
+	}
+	if len(portal.FirstEventID) > 0 {
+		return nil
+	}
+	state, err := portal.MainIntent().State(portal.MXID)
+	if err != nil {
+		return fmt.Errorf("failed to get room state: %w", err)
+	}
+	createEvt, ok := state[event.StateCreate][""]
+	if !ok {
+		return fmt.Errorf("room doesn't have a create event")
+	}
+	portal.FirstEventID = createEvt.ID
+	portal.NextBatchID = ""
+	portal.Update(nil)
+	return nil
+}
+
+// manualBackfill backfills up to count messages older than the oldest bridged
+// message, or all messages since the given time if count is 0. progress is
+// called with the number of messages backfilled so far after every batch.
+func (portal *Portal) manualBackfill(source *User, count int, since time.Time, progress func(int)) (backfillResult, error) {
+	var total backfillResult
+	if err := portal.findBackfillStart(); err != nil {
+		return total, err
+	}
+	before := portal.oldestBackfilledMessage(source)
+	for count <= 0 || total.Count < count {
+		limit := manualBackfillBatchSize
+		if count > 0 && count-total.Count < limit {
+			limit = count - total.Count
+		}
+		res, err := portal.backfill(source, before, limit, since)
+		total.Count += res.Count
+		if err != nil {
+			return total, err
+		}
+		if len(res.Oldest) > 0 {
+			before = res.Oldest
+			total.Oldest = res.Oldest
+		}
+		total.ReachedSince = res.ReachedSince
+		total.ReachedStart = res.ReachedStart
+		if res.ReachedSince || res.ReachedStart {
+			break
+		}
+		progress(total.Count)
+	}
+	return total, nil
+}
+
+// fetchHistory fetches up to limit messages older than before, or the newest
+// messages if before is empty. The messages are returned in chronological
+// order, and messages older than since are left out.
+func (portal *Portal) fetchHistory(source *User, before groupme.ID, limit int, since time.Time) ([]*groupme.Message, backfillResult, error) {
+	var res backfillResult
+	client := source.Client
+	if client == nil {
+		return nil, res, fmt.Errorf("%s isn't logged in", source.MXID)
+	}
+	var messages []*groupme.Message
+	for len(messages) < limit {
+		page, err := client.LoadMessagesBefore(portal.Key.GMID.String(), before.String(), portal.IsPrivateChat())
+		if err != nil {
+			return nil, res, fmt.Errorf("failed to fetch messages before %s: %w", before, err)
+		} else if len(page) == 0 {
+			res.ReachedStart = true
+			break
+		}
+		// GroupMe returns the newest messages first
+		for _, message := range page {
+			if !since.IsZero() && message.CreatedAt.ToTime().Before(since) {
+				res.ReachedSince = true
+				break
+			}
+			messages = append(messages, message)
+			if len(messages) >= limit {
+				break
+			}
+		}
+		if res.ReachedSince {
+			break
+		}
+		before = page[len(page)-1].ID
+	}
+	if len(messages) > 0 {
+		res.Oldest = messages[len(messages)-1].ID
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, res, nil
+}
+
+// backfill inserts up to limit GroupMe messages older than before at the start
+// of the portal, before any messages that have been bridged already.
+func (portal *Portal) backfill(source *User, before groupme.ID, limit int, since time.Time) (backfillResult, error) {
+	portal.backfillLock.Lock()
+	defer portal.backfillLock.Unlock()
+	if len(portal.MXID) == 0 {
+		return backfillResult{}, fmt.Errorf("portal doesn't have a Matrix room")
+	} else if len(portal.FirstEventID) == 0 {
+		return backfillResult{}, fmt.Errorf("portal wasn't set up for backfilling")
+	} else if limit <= 0 {
+		return backfillResult{}, nil
+	}
+
+	messages, res, err := portal.fetchHistory(source, before, limit, since)
+	if err != nil {
+		return res, err
+	}
+	filtered := messages[:0]
+	for _, message := range messages {
+		if message.System || portal.isDuplicate(message.ID) {
+			continue
+		}
+		filtered = append(filtered, message)
+	}
+	if len(filtered) == 0 {
+		return res, nil
+	}
+	res.Count, err = portal.sendBackfillBatch(source, filtered)
+	return res, err
+}
+
+// getBackfillIntent returns the intent that a message should be backfilled
+// with. Batch sending can only use local users, so double puppets are only
+// used if they're allowed in the config.
+func (portal *Portal) getBackfillIntent(source *User, message *groupme.Message) (*Puppet, *appservice.IntentAPI) {
+	sender := message.UserID
+	if portal.IsPrivateChat() && sender != source.GMID {
+		sender = portal.Key.GMID
+	}
+	return portal.getBackfillIntentFor(sender)
+}
+
+// getBackfillIntentFor finds the puppet and intent to backfill events of the
+// given GroupMe user with.
+func (portal *Portal) getBackfillIntentFor(sender groupme.ID) (*Puppet, *appservice.IntentAPI) {
+	puppet := portal.bridge.GetPuppetByGMID(sender)
+	if puppet.customIntent != nil && portal.bridge.Config.CanDoublePuppetBackfill(puppet.CustomMXID) {
+		return puppet, puppet.customIntent
+	}
+	return puppet, puppet.DefaultIntent()
+}
+
+// batchMembers adds the member events of the senders in a batch to the start
+// of the batch.
+type batchMembers struct {
+	portal    *Portal
+	source    *User
+	req       *mautrix.ReqBatchSend
+	timestamp int64
+	added     map[id.UserID]struct{}
+}
+
+func (portal *Portal) newBatchMembers(source *User, req *mautrix.ReqBatchSend, timestamp int64) *batchMembers {
+	return &batchMembers{
+		portal:    portal,
+		source:    source,
+		req:       req,
+		timestamp: timestamp,
+		added:     make(map[id.UserID]struct{}),
+	}
+}
+
+// add makes the intent a member at the start of the batch. member is used to
+// set the puppet's name if it hasn't been synced yet, and may be nil.
+func (bm *batchMembers) add(puppet *Puppet, intent *appservice.IntentAPI, member *groupme.Member) {
+	if _, alreadyAdded := bm.added[intent.UserID]; alreadyAdded {
+		return
+	}
+	puppet.Sync(bm.source, member, false, false)
+	mxid := intent.UserID.String()
+	content := event.MemberEventContent{
+		Membership:  event.MembershipJoin,
+		Displayname: puppet.Displayname,
+		AvatarURL:   puppet.AvatarURL.CUString(),
+	}
+	inviteContent := content
+	inviteContent.Membership = event.MembershipInvite
+	bm.req.StateEventsAtStart = append(bm.req.StateEventsAtStart, &event.Event{
+		Type:      event.StateMember,
+		Sender:    bm.portal.MainIntent().UserID,
+		StateKey:  &mxid,
+		Timestamp: bm.timestamp,
+		Content:   event.Content{Parsed: &inviteContent},
+	}, &event.Event{
+		Type:      event.StateMember,
+		Sender:    intent.UserID,
+		StateKey:  &mxid,
+		Timestamp: bm.timestamp,
+		Content:   event.Content{Parsed: &content},
+	})
+	bm.added[intent.UserID] = struct{}{}
+}
+
+// sendBackfillBatch converts the given messages and inserts them into the room
+// in one batch. The messages must be in chronological order.
+func (portal *Portal) sendBackfillBatch(source *User, messages []*groupme.Message) (int, error) {
+	req := &mautrix.ReqBatchSend{
+		PrevEventID: portal.FirstEventID,
+		BatchID:     portal.NextBatchID,
+	}
+	members := portal.newBatchMembers(source, req, messages[0].CreatedAt.ToTime().UnixMilli())
+	// The index of the last event of each message in req.Events
+	lastEvents := make([]int, len(messages))
+	for i, message := range messages {
+		lastEvents[i] = -1
+		puppet, intent := portal.getBackfillIntent(source, message)
+		var member *groupme.Member
+		if !puppet.NameSet && puppet.GMID == message.UserID {
+			member = &groupme.Member{
+				UserID:   message.UserID,
+				Nickname: message.Name,
+				ImageURL: message.AvatarURL,
+			}
+		}
+		members.add(puppet, intent, member)
+		timestamp := message.CreatedAt.ToTime().UnixMilli()
+		for _, content := range portal.convertMessage(intent, source, message) {
+			evt := &event.Event{
+				Sender:    intent.UserID,
+				Type:      event.EventMessage,
+				Timestamp: timestamp,
+				Content:   event.Content{Parsed: content},
+			}
+			var err error
+			evt.Type, err = portal.encrypt(intent, &evt.Content, evt.Type)
+			if err != nil {
+				portal.log.Errorfln("Failed to encrypt backfilled message %s: %v", message.ID, err)
+				continue
+			}
+			req.Events = append(req.Events, evt)
+			lastEvents[i] = len(req.Events) - 1
+		}
+	}
+	if len(req.Events) == 0 {
+		return 0, nil
+	}
+
+	resp, err := portal.MainIntent().BatchSend(portal.MXID, req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to batch send %d events: %w", len(req.Events), err)
+	}
+	portal.NextBatchID = resp.NextBatchID
+	portal.Update(nil)
+	if len(resp.BaseInsertionEventID) > 0 {
+		portal.sendHistorySyncMarker(resp.BaseInsertionEventID)
+	}
+
+	count := 0
+	eventIDs := make([]id.EventID, len(messages))
+	for i, message := range messages {
+		if lastEvents[i] < 0 || lastEvents[i] >= len(resp.EventIDs) {
+			continue
+		}
+		count++
+		eventIDs[i] = resp.EventIDs[lastEvents[i]]
+		portal.markHandled(source, message, eventIDs[i])
+	}
+	portal.backfillLikes(source, messages, eventIDs)
+	return count, nil
+}
+
+// sendHistorySyncMarker tells the homeserver (and other servers in the room)
+// where the history was inserted, so that it's found when paginating.
+func (portal *Portal) sendHistorySyncMarker(insertionEventID id.EventID) {
+	_, err := portal.MainIntent().SendStateEvent(portal.MXID, HistorySyncMarker, insertionEventID.String(), map[string]interface{}{
+		"org.matrix.msc2716.marker.insertion": insertionEventID,
+	})
+	if err != nil {
+		portal.log.Warnln("Failed to send history sync marker:", err)
+	}
+}
+
+// backfillLikes bridges the likes of backfilled messages as reactions. They
+// can't be part of the batch of the messages, as they have to refer to the
+// message events, so they're sent in a second batch at the same insertion
+// point. The reactions have the timestamp of the message they're on, as
+// GroupMe doesn't say when messages were liked.
+func (portal *Portal) backfillLikes(source *User, messages []*groupme.Message, eventIDs []id.EventID) {
+	req := &mautrix.ReqBatchSend{
+		PrevEventID: portal.FirstEventID,
+		BatchID:     portal.NextBatchID,
+	}
+	members := portal.newBatchMembers(source, req, messages[0].CreatedAt.ToTime().UnixMilli())
+	var likes []*database.Reaction
+	for i, message := range messages {
+		if len(eventIDs[i]) == 0 {
+			continue
+		}
+		for _, liker := range message.FavoritedBy {
+			sender := groupme.ID(liker)
+			puppet, intent := portal.getBackfillIntentFor(sender)
+			members.add(puppet, intent, nil)
+			req.Events = append(req.Events, &event.Event{
+				Sender:    intent.UserID,
+				Type:      event.EventReaction,
+				Timestamp: message.CreatedAt.ToTime().UnixMilli(),
+				Content: event.Content{Parsed: &event.ReactionEventContent{
+					RelatesTo: event.RelatesTo{
+						Type:    event.RelAnnotation,
+						EventID: eventIDs[i],
+						Key:     likeReaction,
+					},
+				}},
+			})
+			reaction := portal.bridge.DB.Reaction.New()
+			reaction.Chat = portal.Key
+			reaction.TargetGMID = message.ID
+			reaction.Sender = sender
+			likes = append(likes, reaction)
+		}
+	}
+	if len(req.Events) == 0 {
+		return
+	}
+
+	resp, err := portal.MainIntent().BatchSend(portal.MXID, req)
+	if err != nil {
+		portal.log.Warnfln("Failed to batch send %d backfilled likes: %v", len(req.Events), err)
+		return
+	}
+	portal.NextBatchID = resp.NextBatchID
+	portal.Update(nil)
+	if len(resp.BaseInsertionEventID) > 0 {
+		portal.sendHistorySyncMarker(resp.BaseInsertionEventID)
+	}
+	for i, reaction := range likes {
+		if i >= len(resp.EventIDs) {
+			break
+		}
+		reaction.MXID = resp.EventIDs[i]
+		reaction.Upsert(nil)
+	}
+}
@@ -0,0 +1,208 @@
+// mautrix-groupme - A Matrix-GroupMe puppeting bridge.
+// Copyright (C) 2022 Sumner Evans, Karmanyaah Malhotra
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"github.com/beeper/groupme-lib"
+
+	"maunium.net/go/mautrix"
+
+	"github.com/beeper/groupme/database"
+)
+
+const (
+	// backfillMaxAttempts is how many times a task is retried after errors
+	// before giving up. GroupMe rate limits don't count as attempts.
+	backfillMaxAttempts    = 5
+	backfillRetryDelay     = 1 * time.Minute
+	backfillRateLimitDelay = 5 * time.Minute
+	// backfillPollInterval is how often idle workers check for tasks that
+	// became due after a delay.
+	backfillPollInterval = 1 * time.Minute
+)
+
+// BackfillQueue runs the backfill tasks stored in the database. Each portal
+// is only backfilled by one worker at a time, and the tasks of a portal run
+// in order of priority.
+type BackfillQueue struct {
+	bridge *GMBridge
+	log    log.Logger
+
+	lock       sync.Mutex
+	inProgress map[database.PortalKey]struct{}
+	wake       chan struct{}
+}
+
+func NewBackfillQueue(br *GMBridge) *BackfillQueue {
+	workers := br.Config.Bridge.HistorySync.Immediate.WorkerCount
+	if workers < 1 {
+		workers = 1
+	}
+	return &BackfillQueue{
+		bridge:     br,
+		log:        br.Log.Sub("BackfillQueue"),
+		inProgress: make(map[database.PortalKey]struct{}),
+		wake:       make(chan struct{}, workers),
+	}
+}
+
+// Start starts the workers, which continue any tasks left from before the
+// bridge was restarted.
+func (bq *BackfillQueue) Start() {
+	bq.log.Debugfln("Starting %d backfill workers", cap(bq.wake))
+	for i := 0; i < cap(bq.wake); i++ {
+		go bq.worker()
+	}
+}
+
+// Wake makes idle workers check for new tasks.
+func (bq *BackfillQueue) Wake() {
+	for i := 0; i < cap(bq.wake); i++ {
+		select {
+		case bq.wake <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+// RunNow runs a task right away instead of waiting for a worker, unless the
+// portal is already being backfilled.
+func (bq *BackfillQueue) RunNow(task *database.Backfill) {
+	if bq.claim(task.Portal) {
+		bq.run(task)
+		bq.release(task.Portal)
+	}
+	bq.Wake()
+}
+
+// IsInProgress checks if a portal is being backfilled right now.
+func (bq *BackfillQueue) IsInProgress(key database.PortalKey) bool {
+	bq.lock.Lock()
+	defer bq.lock.Unlock()
+	_, ok := bq.inProgress[key]
+	return ok
+}
+
+func (bq *BackfillQueue) claim(key database.PortalKey) bool {
+	bq.lock.Lock()
+	defer bq.lock.Unlock()
+	if _, ok := bq.inProgress[key]; ok {
+		return false
+	}
+	bq.inProgress[key] = struct{}{}
+	return true
+}
+
+func (bq *BackfillQueue) release(key database.PortalKey) {
+	bq.lock.Lock()
+	delete(bq.inProgress, key)
+	bq.lock.Unlock()
+}
+
+// next claims the next task that's due. Only the first unfinished task of a
+// user in a portal is considered, so that a delayed retry doesn't let later
+// stages skip ahead.
+func (bq *BackfillQueue) next() *database.Backfill {
+	type userPortal struct {
+		user   string
+		portal database.PortalKey
+	}
+	seen := make(map[userPortal]struct{})
+	now := time.Now()
+	for _, task := range bq.bridge.DB.Backfill.GetPending() {
+		key := userPortal{task.UserID.String(), task.Portal}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		if task.NextAttempt.After(now) {
+			continue
+		} else if bq.claim(task.Portal) {
+			return task
+		}
+	}
+	return nil
+}
+
+func (bq *BackfillQueue) worker() {
+	for {
+		task := bq.next()
+		if task == nil {
+			select {
+			case <-bq.wake:
+			case <-time.After(backfillPollInterval):
+			}
+			continue
+		}
+		bq.run(task)
+		bq.release(task.Portal)
+	}
+}
+
+func isRateLimited(err error) bool {
+	var meta *groupme.Meta
+	if errors.As(err, &meta) {
+		return meta.Code == groupme.HTTPEnhanceYourCalm || meta.Code == 429
+	}
+	return errors.Is(err, mautrix.MLimitExceeded)
+}
+
+func (bq *BackfillQueue) run(task *database.Backfill) {
+	portal := bq.bridge.GetExistingPortalByGMID(task.Portal)
+	if portal == nil || len(portal.MXID) == 0 {
+		bq.log.Debugfln("Dropping backfill %d: portal %s doesn't exist anymore", task.QueueID, task.Portal)
+		task.MarkDone()
+		return
+	}
+	user := bq.bridge.GetUserByMXIDIfExists(task.UserID)
+	if user == nil || len(user.Token) == 0 {
+		bq.log.Debugfln("Dropping backfill %d: %s isn't logged in anymore", task.QueueID, task.UserID)
+		task.MarkDone()
+		return
+	} else if user.Client == nil {
+		// The user isn't connected right now, try again later
+		task.NextAttempt = time.Now().Add(backfillRetryDelay)
+		task.Update()
+		return
+	}
+
+	portal.log.Debugfln("Running %s backfill %d for %s", task.Type, task.QueueID, user.MXID)
+	err := portal.runBackfillTask(user, task)
+	if err == nil {
+		return
+	}
+	delay := backfillRateLimitDelay
+	if !isRateLimited(err) {
+		task.Attempts++
+		if task.Attempts >= backfillMaxAttempts {
+			portal.log.Errorfln("Giving up on %s backfill %d after %d attempts: %v", task.Type, task.QueueID, task.Attempts, err)
+			task.MarkDone()
+			return
+		}
+		delay = backfillRetryDelay * time.Duration(task.Attempts)
+	}
+	portal.log.Warnfln("%s backfill %d failed, retrying in %s: %v", task.Type, task.QueueID, delay, err)
+	task.NextAttempt = time.Now().Add(delay)
+	task.Update()
+}
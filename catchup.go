@@ -0,0 +1,105 @@
+// mautrix-groupme - A Matrix-GroupMe puppeting bridge.
+// Copyright (C) 2022 Sumner Evans, Karmanyaah Malhotra
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/beeper/groupme-lib"
+
+	"github.com/beeper/groupme/groupmeext"
+)
+
+// updateLastMessageID moves the catch-up cursor of the portal forward after a
+// message from GroupMe has been handled.
+func (portal *Portal) updateLastMessageID(messageID groupme.ID) {
+	if len(messageID) == 0 || !groupmeext.IsNewerMessageID(messageID, portal.LastMessageID) {
+		return
+	}
+	portal.LastMessageID = messageID
+	portal.Update(nil)
+}
+
+// seedLastMessageID makes sure the portal has a catch-up cursor. Portals that
+// were created before the cursor existed start from the newest message that
+// was bridged into them. It returns false if there's nothing to start from.
+func (portal *Portal) seedLastMessageID() bool {
+	if len(portal.LastMessageID) > 0 {
+		return true
+	}
+	last := portal.bridge.DB.Message.GetLastInChat(portal.Key)
+	if last == nil || len(last.GMID) == 0 {
+		return false
+	}
+	portal.log.Debugfln("Starting catch-up from %s, the last bridged message", last.GMID)
+	portal.LastMessageID = last.GMID
+	portal.Update(nil)
+	return true
+}
+
+// CatchUp fetches the messages that were sent in the user's chats while the
+// bridge wasn't connected to GroupMe, and passes them to the portals the same
+// way as messages from the push connection.
+func (user *User) CatchUp() {
+	if user.Client == nil {
+		return
+	}
+	user.catchUpLock.Lock()
+	defer user.catchUpLock.Unlock()
+	for _, portal := range user.bridge.GetAllPortals() {
+		if len(portal.MXID) == 0 || !portal.seedLastMessageID() {
+			continue
+		} else if portal.IsPrivateChat() {
+			if portal.Key.Receiver != user.GMID {
+				continue
+			}
+		} else if _, ok := user.GroupList[portal.Key.GMID]; !ok {
+			continue
+		}
+		portal.catchUp(user)
+	}
+}
+
+func (portal *Portal) catchUp(user *User) {
+	after := portal.LastMessageID
+	count := 0
+	for {
+		messages, err := user.Client.LoadMessagesAfter(portal.Key.GMID, after.String(), false, portal.IsPrivateChat())
+		if err != nil {
+			portal.log.Warnfln("Failed to fetch messages after %s to catch up: %v", after, err)
+			break
+		} else if len(messages) == 0 {
+			break
+		}
+		for _, message := range messages {
+			user.queuePortalMessage(portal, PortalMessage{
+				chat:      portal.Key,
+				source:    user,
+				data:      message,
+				timestamp: uint64(message.CreatedAt.ToTime().Unix()),
+				catchUp:   true,
+			})
+		}
+		count += len(messages)
+		newest := messages[len(messages)-1].ID
+		if !groupmeext.IsNewerMessageID(newest, after) {
+			break
+		}
+		after = newest
+	}
+	if count > 0 {
+		portal.log.Infofln("Caught up on %d messages through %s", count, user.MXID)
+	}
+}
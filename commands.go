@@ -17,7 +17,25 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+
+	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/groupme-lib"
+
+	"github.com/beeper/groupme/database"
+	"github.com/beeper/groupme/groupmeext"
 )
 
 type WrappedCommandEvent struct {
@@ -52,25 +70,26 @@ func (br *GMBridge) RegisterCommands() {
 	proc.AddHandlers(
 		// cmdSetRelay,
 		// cmdUnsetRelay,
-		// cmdInviteLink,
-		// cmdResolveLink,
-		// cmdJoin,
+		cmdInviteLink,
+		cmdResolveLink,
+		cmdJoin,
 		// cmdAccept,
-		// cmdCreate,
+		cmdCreate,
 		cmdLogin,
-	// cmdLogout,
+		cmdLogout,
+		cmdDeleteSession,
+		cmdReconnect,
+		cmdDisconnect,
+		cmdPing,
+		cmdBackfill,
+		cmdBackfillStatus,
+		cmdList,
+		cmdSearch,
+		cmdOpen,
+		cmdPM,
 	// cmdTogglePresence,
-	// cmdDeleteSession,
-	// cmdReconnect,
-	// cmdDisconnect,
-	// cmdPing,
 	// cmdDeletePortal,
 	// cmdDeleteAllPortals,
-	// cmdBackfill,
-	// cmdList,
-	// cmdSearch,
-	// cmdOpen,
-	// cmdPM,
 	// cmdSync,
 	// cmdDisappearingTimer,
 	)
@@ -81,7 +100,8 @@ var cmdLogin = &commands.FullHandler{
 	Name: "login",
 	Help: commands.HelpMeta{
 		Section:     commands.HelpSectionAuth,
-		Description: "Link the bridge to your GroupMe account.",
+		Description: "Link the bridge to your GroupMe account, with your password or an access token from https://dev.groupme.com/.",
+		Args:        "[_access token_]",
 	},
 }
 
@@ -95,17 +115,1024 @@ func fnLogin(ce *WrappedCommandEvent) {
 		return
 	}
 
-	if len(ce.Args) < 1 {
-		ce.Reply(`Get your access token from https://dev.groupme.com/ which should be the first argument to login`)
+	if len(ce.Args) > 0 {
+		defer ce.Bot.RedactEvent(ce.RoomID, ce.EventID)
+		finishLogin(ce, ce.Args[0])
+		return
+	}
+
+	ce.User.SetCommandState(&commands.CommandState{
+		Next:   commands.MinimalHandlerFunc(wrapCommand(fnLoginUsername)),
+		Action: "Login",
+		Meta:   ce.User.NewPasswordLogin(),
+	})
+	ce.Reply("Please send your GroupMe email address or phone number, or `cancel` to cancel.")
+}
+
+func fnLoginUsername(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("Please send your GroupMe email address or phone number, or `cancel` to cancel.")
+		return
+	}
+	login := ce.User.GetCommandState().Meta.(*PasswordLogin)
+	login.Username = strings.Join(ce.Args, " ")
+	ce.User.SetCommandState(&commands.CommandState{
+		Next:   commands.MinimalHandlerFunc(wrapCommand(fnLoginPassword)),
+		Action: "Login",
+		Meta:   login,
+	})
+	// Messages that start with a command name run that command instead of
+	// continuing the login, so such passwords would end up in the room.
+	ce.Reply("Please send your GroupMe password. The message will be redacted right away.\n\n" +
+		"If the first word of your password is a bridge command like `help`, send `cancel` and log in with " +
+		"`login <access token>` instead. You can get an access token at https://dev.groupme.com/.")
+}
+
+// commandMessageBody returns the exact text of the message a command came from,
+// as the arguments of the command have their whitespace collapsed.
+func commandMessageBody(ce *WrappedCommandEvent) (string, error) {
+	evt, err := ce.Bot.GetEvent(ce.RoomID, ce.EventID)
+	if err != nil {
+		return "", err
+	}
+	if evt.Type == event.EventEncrypted {
+		if ce.Bridge.Crypto == nil {
+			return "", errors.New("the message is encrypted, but encryption isn't enabled")
+		}
+		evt, err = ce.Bridge.Crypto.Decrypt(evt)
+		if err != nil {
+			return "", fmt.Errorf("failed to decrypt message: %w", err)
+		}
+	}
+	err = evt.Content.ParseRaw(evt.Type)
+	if err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+		return "", err
+	}
+	content := evt.Content.AsMessage()
+	// Strip the command prefix the same way the command processor does
+	if prefix := ce.Bridge.Config.Bridge.GetCommandPrefix(); strings.HasPrefix(content.Body, prefix) {
+		return strings.TrimLeft(strings.TrimPrefix(content.Body, prefix), " "), nil
+	}
+	return content.Body, nil
+}
+
+func fnLoginPassword(ce *WrappedCommandEvent) {
+	defer ce.Bot.RedactEvent(ce.RoomID, ce.EventID)
+	if len(ce.Args) == 0 {
+		ce.Reply("Please send your GroupMe password, or `cancel` to cancel.")
+		return
+	}
+	password, err := commandMessageBody(ce)
+	if err != nil {
+		ce.Bridge.Log.Warnfln("Failed to get password message %s: %v", ce.EventID, err)
+		ce.Reply("Failed to read your password, please try again or `cancel` to cancel.")
 		return
 	}
+	login := ce.User.GetCommandState().Meta.(*PasswordLogin)
+	result, err := login.Client.Login(context.TODO(), login.Username, password)
+	if err != nil {
+		ce.User.SetCommandState(nil)
+		if isUnauthorized(err) {
+			ce.Reply("Incorrect email address, phone number or password.")
+		} else {
+			ce.Reply("Failed to log in: %v", err)
+		}
+		return
+	} else if result.Challenge == nil {
+		ce.User.SetCommandState(nil)
+		finishLogin(ce, result.AccessToken)
+		return
+	}
+
+	login.Challenge = result.Challenge
+	ce.User.SetCommandState(&commands.CommandState{
+		Next:   commands.MinimalHandlerFunc(wrapCommand(fnLoginCode)),
+		Action: "Login",
+		Meta:   login,
+	})
+	ce.Reply(describeChallenge(result.Challenge))
+}
+
+func describeChallenge(challenge *groupmeext.LoginChallenge) string {
+	if challenge.Method == groupmeext.ChallengeMethodPIN {
+		return "Please send your GroupMe PIN."
+	} else if len(challenge.Hint) > 0 {
+		return fmt.Sprintf("GroupMe sent a verification code to %s, please send it here.", challenge.Hint)
+	}
+	return "GroupMe sent you a verification code, please send it here."
+}
 
+func fnLoginCode(ce *WrappedCommandEvent) {
 	defer ce.Bot.RedactEvent(ce.RoomID, ce.EventID)
+	login := ce.User.GetCommandState().Meta.(*PasswordLogin)
+	token, err := login.Client.Verify(context.TODO(), login.Challenge, strings.Join(ce.Args, ""))
+	if isUnauthorized(err) {
+		ce.Reply("Incorrect code, please try again or `cancel` to cancel.")
+		return
+	}
+	ce.User.SetCommandState(nil)
+	if err != nil {
+		ce.Reply("Failed to log in: %v", err)
+		return
+	}
+	finishLogin(ce, token)
+}
 
-	err := ce.User.Login(ce.Args[0])
+func isUnauthorized(err error) bool {
+	var meta *groupme.Meta
+	return errors.As(err, &meta) && meta.Code == groupme.HTTPUnauthorized
+}
+
+func finishLogin(ce *WrappedCommandEvent, token string) {
+	me, err := ce.User.Login(token)
 	if err != nil {
 		ce.Reply("Failed to log in: %v", err)
+		return
+	}
+	ce.Reply("Successfully logged in as %s", formatAccount(me))
+}
+
+func formatAccount(me *groupme.User) string {
+	account := fmt.Sprintf("**%s**", me.Name)
+	var contact []string
+	if len(me.PhoneNumber) > 0 {
+		contact = append(contact, string(me.PhoneNumber))
+	}
+	if len(me.Email) > 0 {
+		contact = append(contact, me.Email)
+	}
+	if len(contact) > 0 {
+		account += fmt.Sprintf(" (%s)", strings.Join(contact, ", "))
+	}
+	return account
+}
+
+var cmdLogout = &commands.FullHandler{
+	Func: wrapCommand(fnLogout),
+	Name: "logout",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAuth,
+		Description: "Unlink the bridge from your GroupMe account, optionally deleting your portals.",
+		Args:        "[--delete-portals]",
+	},
+}
+
+func fnLogout(ce *WrappedCommandEvent) {
+	if !ce.User.HasSession() {
+		ce.Reply("You're not logged in")
+		return
+	}
+	cleanPortals := false
+	if len(ce.Args) > 0 {
+		if ce.Args[0] != "--delete-portals" {
+			ce.Reply("**Usage:** `logout [--delete-portals]`")
+			return
+		}
+		cleanPortals = true
+	}
+	ce.User.Logout(cleanPortals)
+	ce.Reply("Logged out successfully.")
+}
+
+var cmdDeleteSession = &commands.FullHandler{
+	Func: wrapCommand(fnDeleteSession),
+	Name: "delete-session",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAuth,
+		Description: "Forget your GroupMe access token without touching portals or double puppeting.",
+	},
+}
+
+func fnDeleteSession(ce *WrappedCommandEvent) {
+	if !ce.User.HasSession() && !ce.User.IsConnected() {
+		ce.Reply("Nothing to delete")
+		return
+	}
+	ce.User.DeleteSession()
+	ce.Reply("Session deleted successfully.")
+}
+
+var cmdReconnect = &commands.FullHandler{
+	Func: wrapCommand(fnReconnect),
+	Name: "reconnect",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionConnectionManagement,
+		Description: "Reconnect to GroupMe and catch up on missed messages.",
+	},
+}
+
+func fnReconnect(ce *WrappedCommandEvent) {
+	if !ce.User.HasSession() {
+		ce.Reply("You're not logged in")
+		return
+	}
+	if ce.User.Reconnect() {
+		ce.Reply("Reconnected successfully.")
+	} else {
+		ce.Reply("Failed to reconnect, see the bridge logs for details.")
+	}
+}
+
+var cmdDisconnect = &commands.FullHandler{
+	Func: wrapCommand(fnDisconnect),
+	Name: "disconnect",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionConnectionManagement,
+		Description: "Stop receiving messages from GroupMe without logging out.",
+	},
+}
+
+func fnDisconnect(ce *WrappedCommandEvent) {
+	if !ce.User.IsConnected() {
+		ce.Reply("You're not connected")
+		return
+	}
+	ce.User.Disconnect()
+	ce.Reply("Disconnected. Messages you send from Matrix are still bridged, use `reconnect` to receive messages again.")
+}
+
+// pushConnectTimeout is how long the push server may go without answering a
+// connect request before ping reports the push connection as stuck.
+const pushConnectTimeout = 2 * time.Minute
+
+var cmdPing = &commands.FullHandler{
+	Func: wrapCommand(fnPing),
+	Name: "ping",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionConnectionManagement,
+		Description: "Check your connection to GroupMe.",
+	},
+}
+
+func fnPing(ce *WrappedCommandEvent) {
+	if ce.User.Client == nil {
+		ce.Reply("You're not logged in")
+		return
+	}
+
+	var status []string
+	start := time.Now()
+	me, err := ce.User.Client.MyUser(context.TODO())
+	if err != nil {
+		status = append(status, fmt.Sprintf("* GroupMe API: request failed: %v", err))
+	} else {
+		status = append(status, fmt.Sprintf("* GroupMe API: logged in as **%s** (`%s`), answered in %d ms",
+			me.Name, me.ID, time.Since(start).Milliseconds()))
+	}
+
+	if _, faye := ce.User.getConnection(); faye == nil {
+		status = append(status, "* Push connection: disconnected, use `reconnect` to connect again")
+	} else if lastConnect := faye.LastConnect(); lastConnect.IsZero() {
+		status = append(status, "* Push connection: connecting")
+	} else if since := time.Since(lastConnect); since > pushConnectTimeout {
+		status = append(status, fmt.Sprintf("* Push connection: no answer from the push server in %s, try `reconnect`", since.Round(time.Second)))
+	} else {
+		status = append(status, fmt.Sprintf("* Push connection: connected, last answer %s ago", since.Round(time.Second)))
+	}
+	ce.Reply(strings.Join(status, "\n"))
+}
+
+// defaultBackfillCount is the number of messages the backfill command fetches
+// if no count is given.
+const defaultBackfillCount = 50
+
+var cmdBackfill = &commands.FullHandler{
+	Func: wrapCommand(fnBackfill),
+	Name: "backfill",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Backfill older messages into the current portal.",
+		Args:        "[_count_|--since _YYYY-MM-DD_]",
+	},
+}
+
+func fnBackfill(ce *WrappedCommandEvent) {
+	if ce.Portal == nil {
+		ce.Reply("This is not a portal room")
+		return
+	} else if !ce.Bridge.Config.Bridge.HistorySync.Backfill {
+		ce.Reply("Backfilling is disabled on this bridge.")
+		return
+	} else if ce.User.Client == nil {
+		ce.Reply("You're not logged in")
+		return
+	}
+
+	count := defaultBackfillCount
+	var since time.Time
+	if len(ce.Args) > 0 {
+		var err error
+		if ce.Args[0] == "--since" {
+			if len(ce.Args) < 2 {
+				ce.Reply("**Usage:** `backfill [count|--since YYYY-MM-DD]`")
+				return
+			}
+			count = 0
+			since, err = time.ParseInLocation("2006-01-02", ce.Args[1], time.Local)
+			if err != nil {
+				ce.Reply("Invalid date %q, expected YYYY-MM-DD", ce.Args[1])
+				return
+			}
+		} else if count, err = strconv.Atoi(ce.Args[0]); err != nil || count <= 0 {
+			ce.Reply("**Usage:** `backfill [count|--since YYYY-MM-DD]`")
+			return
+		}
+	}
+
+	portal := ce.Portal
+	if !ce.Bridge.BackfillQueue.claim(portal.Key) {
+		ce.Reply("History is already being backfilled into this portal, please try again later.")
+		return
+	}
+	if count > 0 {
+		ce.Reply("Backfilling up to %d older messages...", count)
+	} else {
+		ce.Reply("Backfilling messages since %s...", since.Format("2006-01-02"))
+	}
+	go func() {
+		defer ce.Bridge.BackfillQueue.release(portal.Key)
+		res, err := portal.manualBackfill(ce.User, count, since, func(total int) {
+			ce.Reply("Backfilled %d messages so far...", total)
+		})
+		if err != nil {
+			portal.log.Errorfln("Manual backfill for %s failed: %v", ce.User.MXID, err)
+			ce.Reply("Backfill failed after %d messages: %v", res.Count, err)
+		} else if res.ReachedStart {
+			ce.Reply("Backfilled %d messages and reached the start of the chat.", res.Count)
+		} else {
+			ce.Reply("Finished backfilling %d messages.", res.Count)
+		}
+	}()
+}
+
+var cmdBackfillStatus = &commands.FullHandler{
+	Func: wrapCommand(fnBackfillStatus),
+	Name: "backfill-status",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Show the progress of backfilling history into the current portal, or into all your portals when used outside a portal.",
+	},
+}
+
+func describeBackfill(ce *WrappedCommandEvent, task *database.Backfill) string {
+	stage := "all history"
+	if task.TimeStart != nil {
+		stage = "history since " + task.TimeStart.Format("2006-01-02")
+	}
+	if task.Type == database.BackfillImmediate {
+		stage = "recent messages"
+	}
+	var status string
+	switch {
+	case task.CompletedAt != nil && task.Attempts >= backfillMaxAttempts:
+		status = fmt.Sprintf("gave up after %d attempts (%d messages)", task.Attempts, task.BackfilledCount)
+	case task.CompletedAt != nil:
+		status = fmt.Sprintf("done (%d messages)", task.BackfilledCount)
+	case ce.Bridge.BackfillQueue.IsInProgress(task.Portal) && !task.NextAttempt.After(time.Now()):
+		status = fmt.Sprintf("in progress (%d messages so far)", task.BackfilledCount)
+	case task.Attempts > 0 || task.NextAttempt.After(time.Now()):
+		status = fmt.Sprintf("retrying at %s after %d failed attempts (%d messages so far)",
+			task.NextAttempt.Format("15:04:05"), task.Attempts, task.BackfilledCount)
+	default:
+		status = fmt.Sprintf("pending (%d messages so far)", task.BackfilledCount)
 	}
+	return fmt.Sprintf("* %s: %s", stage, status)
+}
+
+func fnBackfillStatus(ce *WrappedCommandEvent) {
+	if !ce.Bridge.Config.Bridge.HistorySync.Backfill {
+		ce.Reply("Backfilling is disabled on this bridge.")
+		return
+	}
+	if ce.Portal != nil {
+		tasks := ce.Bridge.DB.Backfill.GetAllForPortal(ce.User.MXID, ce.Portal.Key)
+		if len(tasks) == 0 {
+			ce.Reply("No history has been backfilled into this portal for you.")
+			return
+		}
+		lines := make([]string, len(tasks))
+		for i, task := range tasks {
+			lines[i] = describeBackfill(ce, task)
+		}
+		ce.Reply("Backfill progress in this portal:\n\n%s", strings.Join(lines, "\n"))
+		return
+	}
+
+	tasks := ce.Bridge.DB.Backfill.GetAllForUser(ce.User.MXID)
+	if len(tasks) == 0 {
+		ce.Reply("No history has been backfilled for you.")
+		return
+	}
+	var lines []string
+	var lastPortal database.PortalKey
+	for _, task := range tasks {
+		if task.Portal != lastPortal {
+			lastPortal = task.Portal
+			name := task.Portal.String()
+			if portal := ce.Bridge.GetExistingPortalByGMID(task.Portal); portal != nil && len(portal.Name) > 0 {
+				name = portal.Name
+			}
+			lines = append(lines, fmt.Sprintf("\n**%s**", name))
+		}
+		lines = append(lines, describeBackfill(ce, task))
+	}
+	ce.Reply("Backfill progress:\n%s", strings.Join(lines, "\n"))
+}
+
+var cmdPM = &commands.FullHandler{
+	Func: wrapCommand(fnPM),
+	Name: "pm",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionCreatingPortals,
+		Description: "Open a private chat with a GroupMe user.",
+		Args:        "<_GroupMe user ID_|_ghost Matrix ID_|_name_>",
+	},
+}
+
+func fnPM(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `pm <GroupMe user ID|ghost Matrix ID|name>`")
+		return
+	} else if ce.User.Client == nil {
+		ce.Reply("You're not logged in")
+		return
+	}
+
+	query := strings.Join(ce.Args, " ")
+	var candidates map[groupme.ID]groupme.Member
+	if gmid, ok := ce.Bridge.ParsePuppetMXID(id.UserID(query)); ok {
+		candidates = map[groupme.ID]groupme.Member{gmid: {UserID: gmid}}
+	} else if _, err := strconv.ParseUint(query, 10, 64); err == nil {
+		gmid := groupme.ID(query)
+		candidates = map[groupme.ID]groupme.Member{gmid: {UserID: gmid}}
+	} else {
+		candidates = ce.User.SearchContacts(query)
+	}
+
+	switch len(candidates) {
+	case 0:
+		ce.Reply("No GroupMe users found matching %q", query)
+	case 1:
+		for gmid, member := range candidates {
+			startPrivateChat(ce, gmid, member)
+		}
+	default:
+		lines := make([]string, 0, len(candidates))
+		for gmid, member := range candidates {
+			lines = append(lines, fmt.Sprintf("* %s (`%s`)", member.Nickname, gmid))
+		}
+		sort.Strings(lines)
+		ce.Reply("Found %d GroupMe users matching %q:\n\n%s\n\nUse `pm <GroupMe user ID>` to choose one.",
+			len(candidates), query, strings.Join(lines, "\n"))
+	}
+}
+
+func startPrivateChat(ce *WrappedCommandEvent, gmid groupme.ID, member groupme.Member) {
+	if !ce.User.CanMessage(gmid) {
+		ce.Reply("You can only start private chats with GroupMe users you share a group with or have as a contact.")
+		return
+	}
+	if len(member.Nickname) == 0 {
+		member = ce.User.Contacts()[gmid]
+	}
+	puppet := ce.Bridge.GetPuppetByGMID(gmid)
+	if !puppet.NameSet && len(member.Nickname) > 0 {
+		puppet.Sync(ce.User, &member, false, false)
+	}
+	name := puppet.Displayname
+	if len(name) == 0 {
+		name = gmid.String()
+	}
+
+	portal := ce.User.GetPortalByGMID(gmid)
+	if len(portal.MXID) > 0 {
+		portal.ensureUserInvited(ce.User)
+		ce.Reply("You already have a private chat portal with %s at [%[2]s](https://matrix.to/#/%[2]s)", name, portal.MXID)
+		return
+	}
+	portal.Sync(ce.User, nil)
+	if len(portal.MXID) == 0 {
+		ce.Reply("Failed to create a private chat portal with %s", name)
+		return
+	}
+	ce.Reply("Created a private chat portal with %s", name)
+}
+
+func formatPortalLink(portal *Portal) string {
+	if portal == nil || len(portal.MXID) == 0 {
+		return "no portal"
+	}
+	return fmt.Sprintf("[portal](https://matrix.to/#/%s)", portal.MXID)
+}
 
-	ce.Reply("Logged in successfully!")
+func formatLastActivity(ts groupme.Timestamp) string {
+	if ts == 0 {
+		return "no activity"
+	}
+	return "last active " + ts.ToTime().Format("2006-01-02 15:04")
+}
+
+func formatGroupEntry(ce *WrappedCommandEvent, group groupme.Group) string {
+	portal := ce.Bridge.GetExistingPortalByGMID(database.GroupPortalKey(group.ID))
+	lastActivity := group.Messages.LastMessageCreatedAt
+	if lastActivity == 0 {
+		lastActivity = group.UpdatedAt
+	}
+	return fmt.Sprintf("* **%s** (`%s`) - %d members, %s, %s",
+		group.Name, group.ID, len(group.Members), formatLastActivity(lastActivity), formatPortalLink(portal))
+}
+
+func formatContactEntry(ce *WrappedCommandEvent, member groupme.Member) string {
+	portal := ce.Bridge.GetExistingPortalByGMID(ce.User.PortalKey(member.UserID))
+	entry := fmt.Sprintf("* **%s** (`%s`)", member.Nickname, member.UserID)
+	if chat, ok := ce.User.ChatList[member.UserID]; ok {
+		entry += fmt.Sprintf(" - %d messages, %s,", chat.MessagesCount, formatLastActivity(chat.UpdatedAt))
+	} else {
+		entry += " -"
+	}
+	return entry + " " + formatPortalLink(portal)
+}
+
+func listGroups(ce *WrappedCommandEvent, query string) []string {
+	groups := make([]groupme.Group, 0, len(ce.User.GroupList))
+	for _, group := range ce.User.GroupList {
+		if strings.Contains(strings.ToLower(group.Name), query) {
+			groups = append(groups, group)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].UpdatedAt > groups[j].UpdatedAt
+	})
+	lines := make([]string, len(groups))
+	for i, group := range groups {
+		lines[i] = formatGroupEntry(ce, group)
+	}
+	return lines
+}
+
+func listContacts(ce *WrappedCommandEvent, contacts map[groupme.ID]groupme.Member) []string {
+	members := make([]groupme.Member, 0, len(contacts))
+	for _, member := range contacts {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return strings.ToLower(members[i].Nickname) < strings.ToLower(members[j].Nickname)
+	})
+	lines := make([]string, len(members))
+	for i, member := range members {
+		lines[i] = formatContactEntry(ce, member)
+	}
+	return lines
+}
+
+func listDirectChats(ce *WrappedCommandEvent) []string {
+	chats := make([]groupmeext.Chat, 0, len(ce.User.ChatList))
+	for _, chat := range ce.User.ChatList {
+		chats = append(chats, chat)
+	}
+	sort.Slice(chats, func(i, j int) bool {
+		return chats[i].UpdatedAt > chats[j].UpdatedAt
+	})
+	lines := make([]string, len(chats))
+	for i, chat := range chats {
+		lines[i] = formatContactEntry(ce, groupme.Member{UserID: chat.OtherUser.ID, Nickname: chat.OtherUser.Name})
+	}
+	return lines
+}
+
+var cmdList = &commands.FullHandler{
+	Func: wrapCommand(fnList),
+	Name: "list",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionMiscellaneous,
+		Description: "Get a list of all your GroupMe groups, contacts or direct chats.",
+		Args:        "<`groups`|`contacts`|`dms`> [_page_] [_items per page_]",
+	},
+}
+
+func fnList(ce *WrappedCommandEvent) {
+	const usage = "**Usage:** `list <groups|contacts|dms> [page] [items per page]`"
+	if len(ce.Args) == 0 {
+		ce.Reply(usage)
+		return
+	} else if ce.User.Client == nil {
+		ce.Reply("You're not logged in")
+		return
+	}
+
+	var title string
+	var lines []string
+	switch strings.ToLower(ce.Args[0]) {
+	case "group", "groups":
+		title = "Groups"
+		lines = listGroups(ce, "")
+	case "contact", "contacts":
+		title = "Contacts"
+		lines = listContacts(ce, ce.User.Contacts())
+	case "dm", "dms":
+		title = "Direct chats"
+		lines = listDirectChats(ce)
+	default:
+		ce.Reply(usage)
+		return
+	}
+
+	page := 1
+	perPage := 100
+	var err error
+	if len(ce.Args) > 1 {
+		if page, err = strconv.Atoi(ce.Args[1]); err != nil || page <= 0 {
+			ce.Reply("\"%s\" isn't a valid page number", ce.Args[1])
+			return
+		}
+	}
+	if len(ce.Args) > 2 {
+		if perPage, err = strconv.Atoi(ce.Args[2]); err != nil || perPage <= 0 {
+			ce.Reply("\"%s\" isn't a valid number of items per page", ce.Args[2])
+			return
+		} else if perPage > 400 {
+			ce.Reply("Warning: a high number of items per page may fail to send a reply")
+		}
+	}
+
+	if len(lines) == 0 {
+		ce.Reply("No %s found", strings.ToLower(title))
+		return
+	}
+	pages := (len(lines) + perPage - 1) / perPage
+	if page > pages {
+		ce.Reply("There are only %d pages of %s", pages, strings.ToLower(title))
+		return
+	}
+	end := page * perPage
+	if end > len(lines) {
+		end = len(lines)
+	}
+	ce.Reply("### %s (page %d of %d)\n\n%s", title, page, pages, strings.Join(lines[(page-1)*perPage:end], "\n"))
+}
+
+var cmdSearch = &commands.FullHandler{
+	Func: wrapCommand(fnSearch),
+	Name: "search",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionMiscellaneous,
+		Description: "Search your GroupMe groups and contacts by name.",
+		Args:        "<_query_>",
+	},
+}
+
+func fnSearch(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `search <query>`")
+		return
+	} else if ce.User.Client == nil {
+		ce.Reply("You're not logged in")
+		return
+	}
+
+	query := strings.Join(ce.Args, " ")
+	groups := listGroups(ce, strings.ToLower(query))
+	contacts := listContacts(ce, ce.User.SearchContacts(query))
+	if len(groups) == 0 && len(contacts) == 0 {
+		ce.Reply("No groups or contacts found matching %q", query)
+		return
+	}
+	var result strings.Builder
+	if len(groups) > 0 {
+		_, _ = fmt.Fprintf(&result, "### Groups\n\n%s\n\n", strings.Join(groups, "\n"))
+	}
+	if len(contacts) > 0 {
+		_, _ = fmt.Fprintf(&result, "### Contacts\n\n%s", strings.Join(contacts, "\n"))
+	}
+	ce.Reply(strings.TrimSpace(result.String()))
+}
+
+var cmdOpen = &commands.FullHandler{
+	Func: wrapCommand(fnOpen),
+	Name: "open",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionCreatingPortals,
+		Description: "Open a group chat portal.",
+		Args:        "<_group ID_|_name_>",
+	},
+}
+
+func fnOpen(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `open <group ID|name>`")
+		return
+	} else if ce.User.Client == nil {
+		ce.Reply("You're not logged in")
+		return
+	}
+
+	query := strings.Join(ce.Args, " ")
+	group, ok := ce.User.GroupList[groupme.ID(query)]
+	if !ok {
+		var candidates []groupme.Group
+		for _, candidate := range ce.User.GroupList {
+			if strings.Contains(strings.ToLower(candidate.Name), strings.ToLower(query)) {
+				candidates = append(candidates, candidate)
+			}
+		}
+		if len(candidates) == 0 {
+			ce.Reply("You're not in any group matching %q", query)
+			return
+		} else if len(candidates) > 1 {
+			lines := make([]string, len(candidates))
+			for i, candidate := range candidates {
+				lines[i] = formatGroupEntry(ce, candidate)
+			}
+			sort.Strings(lines)
+			ce.Reply("Found %d groups matching %q:\n\n%s\n\nUse `open <group ID>` to choose one.",
+				len(candidates), query, strings.Join(lines, "\n"))
+			return
+		}
+		group = candidates[0]
+	}
+
+	portal := ce.Bridge.GetPortalByGMID(database.GroupPortalKey(group.ID))
+	existed := len(portal.MXID) > 0
+	ce.Reply("Syncing portal for %s...", group.Name)
+	portal.Sync(ce.User, &group)
+	if len(portal.MXID) == 0 {
+		ce.Reply("Failed to create a portal for %s", group.Name)
+	} else if existed {
+		ce.Reply("Portal for %s synced and you've been invited: [%[2]s](https://matrix.to/#/%[2]s)", group.Name, portal.MXID)
+	} else {
+		ce.Reply("Created portal for %s: [%[2]s](https://matrix.to/#/%[2]s)", group.Name, portal.MXID)
+	}
+}
+
+var cmdCreate = &commands.FullHandler{
+	Func: wrapCommand(fnCreate),
+	Name: "create",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionCreatingPortals,
+		Description: "Create a GroupMe group for the current Matrix room.",
+	},
+}
+
+// getGroupMeMembers finds the GroupMe users of the Matrix room members who
+// are ghosts or logged in to the bridge, except the user themselves.
+func getGroupMeMembers(ce *WrappedCommandEvent, members map[id.UserID]mautrix.JoinedMember) []*groupme.Member {
+	var gmMembers []*groupme.Member
+	for mxid, member := range members {
+		var gmid groupme.ID
+		if puppetID, ok := ce.Bridge.ParsePuppetMXID(mxid); ok {
+			gmid = puppetID
+		} else if user := ce.Bridge.GetUserByMXIDIfExists(mxid); user != nil && user.IsLoggedIn() && len(user.GMID) > 0 {
+			gmid = user.GMID
+		} else {
+			continue
+		}
+		if gmid == ce.User.GMID {
+			continue
+		}
+		nickname := ce.Bridge.GetPuppetByGMID(gmid).Displayname
+		if len(nickname) == 0 {
+			nickname = member.DisplayName
+		}
+		if len(nickname) == 0 {
+			nickname = gmid.String()
+		}
+		gmMembers = append(gmMembers, &groupme.Member{UserID: gmid, Nickname: nickname})
+	}
+	return gmMembers
+}
+
+func fnCreate(ce *WrappedCommandEvent) {
+	if ce.Portal != nil {
+		ce.Reply("This is already a portal room")
+		return
+	} else if ce.User.Client == nil {
+		ce.Reply("You're not logged in")
+		return
+	} else if ce.RoomID == ce.User.ManagementRoom {
+		ce.Reply("You can't create a group from your management room")
+		return
+	}
+
+	levels, err := ce.Bot.PowerLevels(ce.RoomID)
+	if err != nil {
+		ce.Reply("Failed to get room power levels: %v", err)
+		return
+	} else if levels.GetUserLevel(ce.Bot.UserID) < levels.GetEventLevel(event.StatePowerLevels) {
+		ce.Reply("Please give the bridge bot permission to change the power levels of the room first")
+		return
+	}
+
+	var roomName event.RoomNameEventContent
+	err = ce.Bot.StateEvent(ce.RoomID, event.StateRoomName, "", &roomName)
+	if err != nil || len(roomName.Name) == 0 {
+		ce.Reply("Please set a name for the room first")
+		return
+	}
+	var topic event.TopicEventContent
+	_ = ce.Bot.StateEvent(ce.RoomID, event.StateTopic, "", &topic)
+	var encryption event.EncryptionEventContent
+	_ = ce.Bot.StateEvent(ce.RoomID, event.StateEncryption, "", &encryption)
+	members, err := ce.Bot.JoinedMembers(ce.RoomID)
+	if err != nil {
+		ce.Reply("Failed to get room members: %v", err)
+		return
+	}
+
+	var avatar event.RoomAvatarEventContent
+	var imageURL string
+	if err = ce.Bot.StateEvent(ce.RoomID, event.StateRoomAvatar, "", &avatar); err == nil && !avatar.URL.IsEmpty() {
+		data, err := ce.Bot.DownloadBytes(avatar.URL)
+		if err == nil {
+			imageURL, err = groupmeext.UploadImage(context.TODO(), data, mimetype.Detect(data).String(), ce.User.Token)
+		}
+		if err != nil {
+			ce.Bridge.Log.Warnfln("Failed to copy avatar of %s to GroupMe: %v", ce.RoomID, err)
+			ce.Reply("Failed to copy the room avatar to GroupMe, creating the group without it")
+		}
+	}
+
+	group, err := ce.User.Client.CreateGroup(context.TODO(), groupme.GroupSettings{
+		Name:        roomName.Name,
+		Description: topic.Topic,
+		ImageURL:    imageURL,
+	})
+	if err != nil {
+		ce.Reply("Failed to create group: %v", err)
+		return
+	}
+	ce.Bridge.Log.Infofln("%s created GroupMe group %s for %s", ce.User.MXID, group.ID, ce.RoomID)
+	if gmMembers := getGroupMeMembers(ce, members.Joined); len(gmMembers) > 0 {
+		_, err = ce.User.Client.AddMembers(context.TODO(), group.ID, gmMembers...)
+		if err != nil {
+			ce.Reply("Created group, but failed to add the room members to it: %v", err)
+		}
+	}
+
+	portal := ce.Bridge.GetPortalByGMID(database.GroupPortalKey(group.ID))
+	portal.roomCreateLock.Lock()
+	portal.MXID = ce.RoomID
+	portal.Name = group.Name
+	portal.NameSet = true
+	portal.Topic = group.Description
+	portal.TopicSet = true
+	portal.Avatar = group.ImageURL
+	portal.AvatarURL = avatar.URL
+	portal.AvatarSet = !portal.AvatarURL.IsEmpty()
+	portal.Encrypted = encryption.Algorithm == id.AlgorithmMegolmV1
+	portal.Update(nil)
+	portal.roomCreateLock.Unlock()
+	ce.Bridge.portalsLock.Lock()
+	ce.Bridge.portalsByMXID[portal.MXID] = portal
+	ce.Bridge.portalsLock.Unlock()
+
+	portal.UpdateBridgeInfo()
+	portal.Sync(ce.User, group)
+	go ce.User.HandleChatList()
+	ce.Reply("Created GroupMe group %s and bridged this room to it", group.Name)
+}
+
+func formatGroupPreview(group *groupmeext.GroupInfo) string {
+	approval := "anyone with the link can join"
+	if group.RequiresApproval {
+		approval = "joining requires approval from an admin"
+	}
+	preview := fmt.Sprintf("**%s** (`%s`) - %d members, %s", group.Name, group.ID, group.GetMembersCount(), approval)
+	if len(group.Description) > 0 {
+		preview += "\n\n" + group.Description
+	}
+	return preview
+}
+
+var cmdResolveLink = &commands.FullHandler{
+	Func: wrapCommand(fnResolveLink),
+	Name: "resolve-link",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionInvites,
+		Description: "Get info about a GroupMe group share link.",
+		Args:        "<_share link_>",
+	},
+}
+
+func fnResolveLink(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `resolve-link <share link>`")
+		return
+	} else if ce.User.Client == nil {
+		ce.Reply("You're not logged in")
+		return
+	}
+	groupID, token, err := groupmeext.ParseShareURL(ce.Args[0])
+	if err != nil {
+		ce.Reply("That doesn't look like a GroupMe share link")
+		return
+	}
+	group, err := ce.User.Client.PreviewGroup(context.TODO(), groupID, token)
+	if err != nil {
+		ce.Reply("Failed to get group info: %v", err)
+		return
+	}
+	ce.Reply(formatGroupPreview(group))
+}
+
+var cmdJoin = &commands.FullHandler{
+	Func: wrapCommand(fnJoin),
+	Name: "join",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionInvites,
+		Description: "Join a GroupMe group with a share link.",
+		Args:        "<_share link_>",
+	},
+}
+
+func fnJoin(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage:** `join <share link>`")
+		return
+	} else if ce.User.Client == nil {
+		ce.Reply("You're not logged in")
+		return
+	}
+	groupID, token, err := groupmeext.ParseShareURL(ce.Args[0])
+	if err != nil {
+		ce.Reply("That doesn't look like a GroupMe share link")
+		return
+	}
+	if _, ok := ce.User.GroupList[groupID]; ok {
+		ce.Reply("You're already in that group, use `open %s` to get a portal for it", groupID)
+		return
+	}
+	preview, err := ce.User.Client.PreviewGroup(context.TODO(), groupID, token)
+	if err != nil {
+		ce.Reply("Failed to get group info: %v", err)
+		return
+	}
+	group, err := ce.User.Client.JoinGroupWithToken(context.TODO(), groupID, token)
+	if err != nil {
+		ce.Reply("Failed to join group: %v", err)
+		return
+	} else if preview.RequiresApproval || group == nil || len(group.ID) == 0 {
+		ce.Reply("Requested to join %s. The portal will be created once an admin approves the request.", preview.Name)
+		return
+	}
+	ce.Bridge.Log.Infofln("%s joined group %s with a share link", ce.User.MXID, groupID)
+
+	ce.User.HandleChatList()
+	portal := ce.Bridge.GetPortalByGMID(database.GroupPortalKey(groupID))
+	portal.Sync(ce.User, &group.Group)
+	if len(portal.MXID) == 0 {
+		ce.Reply("Joined %s, but failed to create a portal for it", group.Name)
+		return
+	}
+	ce.Reply("Joined %s: [%[2]s](https://matrix.to/#/%[2]s)", group.Name, portal.MXID)
+}
+
+var cmdInviteLink = &commands.FullHandler{
+	Func: wrapCommand(fnInviteLink),
+	Name: "invite-link",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionInvites,
+		Description: "Get the share link of the current group, or generate a new one with `--reset`.",
+		Args:        "[--reset]",
+	},
+}
+
+func fnInviteLink(ce *WrappedCommandEvent) {
+	if ce.Portal == nil || ce.Portal.IsPrivateChat() {
+		ce.Reply("This is not a group portal room")
+		return
+	} else if ce.User.Client == nil {
+		ce.Reply("You're not logged in")
+		return
+	}
+	reset := len(ce.Args) > 0 && ce.Args[0] == "--reset"
+
+	group, err := ce.User.Client.ShowGroupInfo(context.TODO(), ce.Portal.Key.GMID)
+	if err != nil {
+		ce.Reply("Failed to get group info: %v", err)
+		return
+	}
+	member := group.GetMember(ce.User.GMID)
+	if member == nil {
+		ce.Reply("You're not in this group")
+		return
+	}
+	shareURL := group.ShareURL
+	if reset {
+		if !member.IsAdmin() {
+			ce.Reply("Only admins can reset the share link")
+			return
+		}
+		shareURL, err = ce.User.Client.ResetShareURL(context.TODO(), group.ID)
+		if err != nil {
+			ce.Reply("Failed to reset share link: %v", err)
+			return
+		}
+	}
+	if len(shareURL) > 0 {
+		ce.Reply(shareURL)
+	} else if member.IsAdmin() {
+		ce.Reply("Sharing is disabled for this group. Use `invite-link --reset` to enable it.")
+	} else {
+		ce.Reply("Sharing is disabled for this group, and only admins can enable it.")
+	}
 }
@@ -37,8 +37,9 @@ type DeferredConfig struct {
 }
 
 type BridgeConfig struct {
-	UsernameTemplate    string `yaml:"username_template"`
-	DisplaynameTemplate string `yaml:"displayname_template"`
+	UsernameTemplate          string `yaml:"username_template"`
+	DisplaynameTemplate       string `yaml:"displayname_template"`
+	DisplaynameDisambiguation string `yaml:"displayname_disambiguation"`
 
 	PersonalFilteringSpaces bool `yaml:"personal_filtering_spaces"`
 
@@ -46,6 +47,10 @@ type BridgeConfig struct {
 	MessageStatusEvents bool `yaml:"message_status_events"`
 	MessageErrorNotices bool `yaml:"message_error_notices"`
 	PortalMessageBuffer int  `yaml:"portal_message_buffer"`
+	MaxMediaSize        int  `yaml:"max_media_size"`
+
+	InitialChatSync int   `yaml:"initial_chat_sync_count"`
+	SyncMaxChatAge  int64 `yaml:"sync_max_chat_age"`
 
 	SyncWithCustomPuppets  bool `yaml:"sync_with_custom_puppets"`
 	SyncDirectChatList     bool `yaml:"sync_direct_chat_list"`
@@ -116,6 +121,15 @@ func (bc BridgeConfig) EnableMessageErrorNotices() bool {
 	return bc.MessageErrorNotices
 }
 
+// MaxMediaBytes returns the maximum size of GroupMe media to bridge in bytes,
+// or -1 if there's no limit.
+func (bc BridgeConfig) MaxMediaBytes() int64 {
+	if bc.MaxMediaSize <= 0 {
+		return -1
+	}
+	return int64(bc.MaxMediaSize) * 1024 * 1024
+}
+
 func (bc BridgeConfig) GetCommandPrefix() string {
 	return bc.CommandPrefix
 }
@@ -165,6 +179,13 @@ func (bc *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err != nil {
 		return err
 	}
+	switch bc.DisplaynameDisambiguation {
+	case "":
+		bc.DisplaynameDisambiguation = DisambiguateNone
+	case DisambiguateNone, DisambiguateUserIDSuffix, DisambiguateUserID:
+	default:
+		return fmt.Errorf("unknown displayname disambiguation strategy %q", bc.DisplaynameDisambiguation)
+	}
 
 	if bc.MessageHandlingTimeout.ErrorAfterStr != "" {
 		bc.MessageHandlingTimeout.ErrorAfter, err = time.ParseDuration(bc.MessageHandlingTimeout.ErrorAfterStr)
@@ -186,12 +207,49 @@ type UsernameTemplateArgs struct {
 	UserID id.UserID
 }
 
-func (bc BridgeConfig) FormatDisplayname(gmid groupme.ID, member groupme.Member) string {
+// Strategies for telling apart members of a group with the same nickname.
+const (
+	DisambiguateNone         = "none"
+	DisambiguateUserIDSuffix = "user_id_suffix"
+	DisambiguateUserID       = "user_id"
+)
+
+type DisplaynameTemplateArgs struct {
+	UserID   groupme.ID
+	Nickname string
+	ImageURL string
+
+	// UserIDSuffix is the last four digits of the user ID.
+	UserIDSuffix string
+	// SMS is true if the user uses GroupMe over SMS instead of the app.
+	SMS bool
+	// Collision is true if another member of the group has the same nickname.
+	Collision bool
+}
+
+func (bc BridgeConfig) FormatDisplayname(args DisplaynameTemplateArgs) string {
+	userID := args.UserID.String()
+	args.UserIDSuffix = userID
+	if len(userID) > 4 {
+		args.UserIDSuffix = userID[len(userID)-4:]
+	}
+	if args.Collision && len(args.Nickname) > 0 {
+		switch bc.DisplaynameDisambiguation {
+		case DisambiguateUserIDSuffix:
+			args.Nickname = fmt.Sprintf("%s #%s", args.Nickname, args.UserIDSuffix)
+		case DisambiguateUserID:
+			args.Nickname = fmt.Sprintf("%s #%s", args.Nickname, userID)
+		}
+	}
+
 	var buf strings.Builder
-	_ = bc.displaynameTemplate.Execute(&buf, map[string]string{
-		"Name": member.Nickname,
-		"GMID": gmid.String(),
-	})
+	err := bc.displaynameTemplate.Execute(&buf, args)
+	if err != nil {
+		if len(args.Nickname) > 0 {
+			return args.Nickname
+		}
+		return userID
+	}
 	return buf.String()
 }
 
@@ -37,6 +37,8 @@ type Config struct {
 		OSName            string `yaml:"os_name"`
 		BrowserName       string `yaml:"browser_name"`
 		ConnectionTimeout int    `yaml:"connection_timeout"`
+		LoginBaseURL      string `yaml:"login_base_url"`
+		APIBaseURL        string `yaml:"api_base_url"`
 	} `yaml:"groupme"`
 
 	Bridge BridgeConfig `yaml:"bridge"`
@@ -18,19 +18,30 @@ func DoUpgrade(helper *up.Helper) {
 
 	helper.Copy(up.Int, "groupme", "connection_timeout")
 	helper.Copy(up.Bool, "groupme", "fetch_message_on_timeout")
+	helper.Copy(up.Str, "groupme", "login_base_url")
+	helper.Copy(up.Str, "groupme", "api_base_url")
 
 	helper.Copy(up.Str, "bridge", "username_template")
 	helper.Copy(up.Str, "bridge", "displayname_template")
+	helper.Copy(up.Str, "bridge", "displayname_disambiguation")
 	helper.Copy(up.Bool, "bridge", "personal_filtering_spaces")
 	helper.Copy(up.Bool, "bridge", "delivery_receipts")
 	helper.Copy(up.Bool, "bridge", "message_status_events")
 	helper.Copy(up.Bool, "bridge", "message_error_notices")
 
 	helper.Copy(up.Int, "bridge", "portal_message_buffer")
+	helper.Copy(up.Int, "bridge", "max_media_size")
 	helper.Copy(up.Bool, "bridge", "call_start_notices")
 	helper.Copy(up.Bool, "bridge", "identity_change_notices")
 	helper.Copy(up.Bool, "bridge", "user_avatar_sync")
 	helper.Copy(up.Bool, "bridge", "bridge_matrix_leave")
+	helper.Copy(up.Int, "bridge", "initial_chat_sync_count")
+	helper.Copy(up.Int, "bridge", "sync_max_chat_age")
+	helper.Copy(up.Bool, "bridge", "history_sync", "backfill")
+	helper.Copy(up.Bool, "bridge", "history_sync", "double_puppet_backfill")
+	helper.Copy(up.Int, "bridge", "history_sync", "immediate", "worker_count")
+	helper.Copy(up.Int, "bridge", "history_sync", "immediate", "max_events")
+	helper.Copy(up.List, "bridge", "history_sync", "deferred")
 	helper.Copy(up.Bool, "bridge", "sync_with_custom_puppets")
 	helper.Copy(up.Bool, "bridge", "sync_direct_chat_list")
 	helper.Copy(up.Bool, "bridge", "default_bridge_receipts")
@@ -122,6 +133,7 @@ var SpacedBlocks = [][]string{
 	{"metrics"},
 	{"groupme"},
 	{"bridge"},
+	{"bridge", "history_sync"},
 	{"bridge", "command_prefix"},
 	{"bridge", "management_room_text"},
 	{"bridge", "encryption"},
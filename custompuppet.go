@@ -202,6 +202,7 @@ func (puppet *Puppet) ProcessResponse(resp *mautrix.RespSync, _ string) error {
 			switch evt.Type {
 			case event.EphemeralEventReceipt:
 				if puppet.EnableReceipts {
+					puppet.filterOwnReceipts(evt.Content.AsReceipt())
 					go puppet.bridge.MatrixHandler.HandleReceipt(evt)
 				}
 			case event.EphemeralEventTyping:
@@ -212,6 +213,21 @@ func (puppet *Puppet) ProcessResponse(resp *mautrix.RespSync, _ string) error {
 	return nil
 }
 
+// filterOwnReceipts removes the receipts of everyone except the double puppeted
+// user, since the bridge handles those through its own ephemeral events.
+func (puppet *Puppet) filterOwnReceipts(content *event.ReceiptEventContent) {
+	for eventID, receipts := range *content {
+		receipt, ok := receipts[event.ReceiptTypeRead][puppet.CustomMXID]
+		if !ok {
+			delete(*content, eventID)
+			continue
+		}
+		(*content)[eventID] = event.Receipts{
+			event.ReceiptTypeRead: {puppet.CustomMXID: receipt},
+		}
+	}
+}
+
 func (puppet *Puppet) tryRelogin(cause error, action string) bool {
 	if !puppet.bridge.Config.CanAutoDoublePuppet(puppet.CustomMXID) {
 		return false
@@ -0,0 +1,253 @@
+// mautrix-groupme - A Matrix-GroupMe puppeting bridge.
+// Copyright (C) 2022 Sumner Evans, Karmanyaah Malhotra
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+
+	"github.com/beeper/groupme-lib"
+)
+
+type BackfillType int
+
+const (
+	BackfillImmediate BackfillType = 0
+	BackfillDeferred  BackfillType = 1
+)
+
+func (bt BackfillType) String() string {
+	switch bt {
+	case BackfillImmediate:
+		return "immediate"
+	case BackfillDeferred:
+		return "deferred"
+	default:
+		return "unknown"
+	}
+}
+
+type BackfillQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (bq *BackfillQuery) New() *Backfill {
+	return &Backfill{
+		db:  bq.db,
+		log: bq.log,
+	}
+}
+
+const (
+	backfillColumns = `
+		queue_id, user_mxid, portal_gmid, portal_receiver, type, priority, time_start, max_batch_events, batch_delay,
+		max_total_events, oldest_message_id, backfilled_count, attempts, next_attempt, completed_at
+	`
+	getPendingBackfillsQuery = `
+		SELECT ` + backfillColumns + ` FROM backfill_queue
+		WHERE completed_at IS NULL
+		ORDER BY priority, queue_id
+	`
+	getAllBackfillsForPortalQuery = `
+		SELECT ` + backfillColumns + ` FROM backfill_queue
+		WHERE user_mxid=$1 AND portal_gmid=$2 AND portal_receiver=$3
+		ORDER BY priority, queue_id
+	`
+	getAllBackfillsForUserQuery = `
+		SELECT ` + backfillColumns + ` FROM backfill_queue
+		WHERE user_mxid=$1
+		ORDER BY portal_gmid, portal_receiver, priority, queue_id
+	`
+	insertBackfillQuery = `
+		INSERT INTO backfill_queue (user_mxid, portal_gmid, portal_receiver, type, priority, time_start, max_batch_events,
+		                            batch_delay, max_total_events, oldest_message_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING queue_id
+	`
+	updateBackfillQuery = `
+		UPDATE backfill_queue
+		SET oldest_message_id=$1, backfilled_count=$2, attempts=$3, next_attempt=$4, completed_at=$5
+		WHERE queue_id=$6
+	`
+	completeAllBackfillsForPortalQuery = `
+		UPDATE backfill_queue SET completed_at=$1
+		WHERE user_mxid=$2 AND portal_gmid=$3 AND portal_receiver=$4 AND completed_at IS NULL
+	`
+	deleteAllBackfillsForUserQuery = `
+		DELETE FROM backfill_queue WHERE user_mxid=$1
+	`
+)
+
+// NewWithValues creates a new backfill task. timeStart is where the task
+// stops going back in history, or nil to go back to the start of the chat.
+func (bq *BackfillQuery) NewWithValues(userID id.UserID, portal PortalKey, backfillType BackfillType, priority int, timeStart *time.Time, maxBatchEvents, batchDelay, maxTotalEvents int) *Backfill {
+	return &Backfill{
+		db:             bq.db,
+		log:            bq.log,
+		UserID:         userID,
+		Portal:         portal,
+		Type:           backfillType,
+		Priority:       priority,
+		TimeStart:      timeStart,
+		MaxBatchEvents: maxBatchEvents,
+		BatchDelay:     batchDelay,
+		MaxTotalEvents: maxTotalEvents,
+	}
+}
+
+// GetPending returns the tasks that haven't been completed, in the order
+// they should be processed.
+func (bq *BackfillQuery) GetPending() []*Backfill {
+	return bq.getAll(getPendingBackfillsQuery)
+}
+
+func (bq *BackfillQuery) GetAllForPortal(userID id.UserID, portal PortalKey) []*Backfill {
+	return bq.getAll(getAllBackfillsForPortalQuery, userID, portal.GMID, portal.Receiver)
+}
+
+func (bq *BackfillQuery) GetAllForUser(userID id.UserID) []*Backfill {
+	return bq.getAll(getAllBackfillsForUserQuery, userID)
+}
+
+// CompleteAllForPortal marks all remaining tasks of a user in a portal as
+// completed, e.g. when the start of the chat has been reached.
+func (bq *BackfillQuery) CompleteAllForPortal(userID id.UserID, portal PortalKey) {
+	_, err := bq.db.Exec(completeAllBackfillsForPortalQuery, time.Now().Unix(), userID, portal.GMID, portal.Receiver)
+	if err != nil {
+		bq.log.Warnfln("Failed to complete backfills of %s in %s: %v", userID, portal, err)
+	}
+}
+
+// DeleteAllForUser deletes all tasks of a user, e.g. when they log out, so
+// that they aren't continued with the session of another account.
+func (bq *BackfillQuery) DeleteAllForUser(userID id.UserID) {
+	_, err := bq.db.Exec(deleteAllBackfillsForUserQuery, userID)
+	if err != nil {
+		bq.log.Warnfln("Failed to delete backfills of %s: %v", userID, err)
+	}
+}
+
+func (bq *BackfillQuery) getAll(query string, args ...interface{}) (backfills []*Backfill) {
+	rows, err := bq.db.Query(query, args...)
+	if err != nil || rows == nil {
+		if err != nil {
+			bq.log.Errorln("Failed to query backfill queue:", err)
+		}
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if backfill := bq.New().Scan(rows); backfill != nil {
+			backfills = append(backfills, backfill)
+		}
+	}
+	return
+}
+
+// Backfill is a task to backfill history into a portal on behalf of a user.
+type Backfill struct {
+	db  *Database
+	log log.Logger
+
+	QueueID  int
+	UserID   id.UserID
+	Portal   PortalKey
+	Type     BackfillType
+	Priority int
+
+	TimeStart      *time.Time
+	MaxBatchEvents int
+	// Seconds to wait between batches
+	BatchDelay int
+	// Maximum number of messages to backfill in total, or 0 for no limit
+	MaxTotalEvents int
+
+	// OldestMessageID is the oldest GroupMe message the task has reached.
+	OldestMessageID groupme.ID
+	BackfilledCount int
+	Attempts        int
+	NextAttempt     time.Time
+	CompletedAt     *time.Time
+}
+
+func (b *Backfill) Scan(row dbutil.Scannable) *Backfill {
+	var timeStart, completedAt sql.NullInt64
+	var nextAttempt int64
+	err := row.Scan(&b.QueueID, &b.UserID, &b.Portal.GMID, &b.Portal.Receiver, &b.Type, &b.Priority, &timeStart,
+		&b.MaxBatchEvents, &b.BatchDelay, &b.MaxTotalEvents, &b.OldestMessageID, &b.BackfilledCount, &b.Attempts,
+		&nextAttempt, &completedAt)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			b.log.Errorln("Database scan failed:", err)
+		}
+		return nil
+	}
+	if timeStart.Valid {
+		ts := time.Unix(timeStart.Int64, 0)
+		b.TimeStart = &ts
+	}
+	if nextAttempt != 0 {
+		b.NextAttempt = time.Unix(nextAttempt, 0)
+	}
+	if completedAt.Valid {
+		ts := time.Unix(completedAt.Int64, 0)
+		b.CompletedAt = &ts
+	}
+	return b
+}
+
+func unixPtr(ts *time.Time) *int64 {
+	if ts == nil {
+		return nil
+	}
+	unix := ts.Unix()
+	return &unix
+}
+
+func (b *Backfill) Insert() {
+	err := b.db.QueryRow(insertBackfillQuery,
+		b.UserID, b.Portal.GMID, b.Portal.Receiver, b.Type, b.Priority, unixPtr(b.TimeStart), b.MaxBatchEvents,
+		b.BatchDelay, b.MaxTotalEvents, b.OldestMessageID,
+	).Scan(&b.QueueID)
+	if err != nil {
+		b.log.Warnfln("Failed to insert %s backfill of %s for %s: %v", b.Type, b.Portal, b.UserID, err)
+	}
+}
+
+// Update saves the progress of the task.
+func (b *Backfill) Update() {
+	var nextAttempt int64
+	if !b.NextAttempt.IsZero() {
+		nextAttempt = b.NextAttempt.Unix()
+	}
+	_, err := b.db.Exec(updateBackfillQuery, b.OldestMessageID, b.BackfilledCount, b.Attempts, nextAttempt, unixPtr(b.CompletedAt), b.QueueID)
+	if err != nil {
+		b.log.Warnfln("Failed to update backfill %d: %v", b.QueueID, err)
+	}
+}
+
+func (b *Backfill) MarkDone() {
+	now := time.Now()
+	b.CompletedAt = &now
+	b.Update()
+}
@@ -38,6 +38,9 @@ type Database struct {
 	Puppet   *PuppetQuery
 	Message  *MessageQuery
 	Reaction *ReactionQuery
+	Media    *MediaQuery
+	Nickname *NicknameQuery
+	Backfill *BackfillQuery
 }
 
 func New(baseDB *dbutil.Database, log maulogger.Logger) *Database {
@@ -63,6 +66,18 @@ func New(baseDB *dbutil.Database, log maulogger.Logger) *Database {
 		db:  db,
 		log: log.Sub("Reaction"),
 	}
+	db.Media = &MediaQuery{
+		db:  db,
+		log: log.Sub("Media"),
+	}
+	db.Nickname = &NicknameQuery{
+		db:  db,
+		log: log.Sub("Nickname"),
+	}
+	db.Backfill = &BackfillQuery{
+		db:  db,
+		log: log.Sub("Backfill"),
+	}
 	return db
 }
 
@@ -0,0 +1,91 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	log "maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+type MediaQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (mq *MediaQuery) New() *Media {
+	return &Media{
+		db:  mq.db,
+		log: mq.log,
+	}
+}
+
+const (
+	getMediaByURLQuery = `
+		SELECT url, mxc, size, mime_type, file_name, width, height, duration FROM media WHERE url=$1
+	`
+	getMediaByMXCQuery = `
+		SELECT url, mxc, size, mime_type, file_name, width, height, duration FROM media WHERE mxc=$1
+	`
+	upsertMediaQuery = `
+		INSERT INTO media (url, mxc, size, mime_type, file_name, width, height, duration)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (url) DO UPDATE
+			SET mxc=excluded.mxc, size=excluded.size, mime_type=excluded.mime_type, file_name=excluded.file_name,
+			    width=excluded.width, height=excluded.height, duration=excluded.duration
+	`
+)
+
+// GetByURL finds an earlier upload of the GroupMe image or file at the given URL.
+func (mq *MediaQuery) GetByURL(url string) *Media {
+	return mq.maybeScan(mq.db.QueryRow(getMediaByURLQuery, url))
+}
+
+// GetByMXC finds the GroupMe media that was bridged to the given Matrix content URI.
+func (mq *MediaQuery) GetByMXC(mxc id.ContentURI) *Media {
+	return mq.maybeScan(mq.db.QueryRow(getMediaByMXCQuery, mxc.String()))
+}
+
+func (mq *MediaQuery) maybeScan(row *sql.Row) *Media {
+	if row == nil {
+		return nil
+	}
+	return mq.New().Scan(row)
+}
+
+// Media is an unencrypted upload of GroupMe media to the homeserver.
+type Media struct {
+	db  *Database
+	log log.Logger
+
+	URL      string
+	MXC      id.ContentURI
+	Size     int64
+	MimeType string
+	FileName string
+	Width    int
+	Height   int
+	// Duration of videos in milliseconds
+	Duration int
+}
+
+func (media *Media) Scan(row dbutil.Scannable) *Media {
+	var mxc string
+	err := row.Scan(&media.URL, &mxc, &media.Size, &media.MimeType, &media.FileName, &media.Width, &media.Height, &media.Duration)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			media.log.Errorln("Database scan failed:", err)
+		}
+		return nil
+	}
+	media.MXC, _ = id.ParseContentURI(mxc)
+	return media
+}
+
+func (media *Media) Upsert() {
+	_, err := media.db.Exec(upsertMediaQuery, media.URL, media.MXC.String(), media.Size, media.MimeType, media.FileName, media.Width, media.Height, media.Duration)
+	if err != nil {
+		media.log.Warnfln("Failed to upsert media %s: %v", media.URL, err)
+	}
+}
@@ -43,12 +43,12 @@ func (mq *MessageQuery) New() *Message {
 const (
 	getAllMessagesSelect = `
 		SELECT chat_gmid, chat_receiver, gmid, mxid, sender, timestamp, sent
-		FROM messages
+		FROM message
 	`
 	getAllMessagesQuery = getAllMessagesSelect + `
 		WHERE chat_gmid=$1 AND chat_receiver=$2
 	`
-	getByGMIDQuery            = getAllMessagesQuery + "AND jid=$3"
+	getByGMIDQuery            = getAllMessagesQuery + "AND gmid=$3"
 	getByMXIDQuery            = getAllMessagesSelect + "WHERE mxid=$1"
 	getLastMessageInChatQuery = getAllMessagesQuery + `
 		AND timestamp<=$3 AND sent=true
@@ -143,3 +143,13 @@ func (msg *Message) Scan(row dbutil.Scannable) *Message {
 	}
 	return msg
 }
+
+func (msg *Message) Insert() {
+	_, err := msg.db.Exec(`
+		INSERT INTO message (chat_gmid, chat_receiver, gmid, mxid, sender, timestamp, sent)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, msg.Chat.GMID, msg.Chat.Receiver, msg.GMID, msg.MXID, msg.Sender, msg.Timestamp.Unix(), msg.Sent)
+	if err != nil {
+		msg.log.Warnfln("Failed to insert %s@%s: %v", msg.GMID, msg.Chat, err)
+	}
+}
@@ -0,0 +1,117 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	log "maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/util/dbutil"
+
+	"github.com/beeper/groupme-lib"
+)
+
+type NicknameQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (nq *NicknameQuery) New() *Nickname {
+	return &Nickname{
+		db:  nq.db,
+		log: nq.log,
+	}
+}
+
+const (
+	getNicknameQuery = `
+		SELECT portal_gmid, portal_receiver, user_gmid, nickname, displayname, name_set, sms FROM nickname
+		WHERE portal_gmid=$1 AND portal_receiver=$2 AND user_gmid=$3
+	`
+	getAllNicknamesByPortalQuery = `
+		SELECT portal_gmid, portal_receiver, user_gmid, nickname, displayname, name_set, sms FROM nickname
+		WHERE portal_gmid=$1 AND portal_receiver=$2
+	`
+	getAllNicknamesByUserQuery = `
+		SELECT portal_gmid, portal_receiver, user_gmid, nickname, displayname, name_set, sms FROM nickname WHERE user_gmid=$1
+	`
+	upsertNicknameQuery = `
+		INSERT INTO nickname (portal_gmid, portal_receiver, user_gmid, nickname, displayname, name_set, sms)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (portal_gmid, portal_receiver, user_gmid)
+			DO UPDATE SET nickname=excluded.nickname, displayname=excluded.displayname, name_set=excluded.name_set, sms=excluded.sms
+	`
+	deleteNicknameQuery = `
+		DELETE FROM nickname WHERE portal_gmid=$1 AND portal_receiver=$2 AND user_gmid=$3
+	`
+)
+
+func (nq *NicknameQuery) Get(portal PortalKey, user groupme.ID) *Nickname {
+	row := nq.db.QueryRow(getNicknameQuery, portal.GMID, portal.Receiver, user)
+	if row == nil {
+		return nil
+	}
+	return nq.New().Scan(row)
+}
+
+// GetAllByPortal returns the nicknames of every member of a portal.
+func (nq *NicknameQuery) GetAllByPortal(portal PortalKey) []*Nickname {
+	return nq.getAll(getAllNicknamesByPortalQuery, portal.GMID, portal.Receiver)
+}
+
+// GetAllByUser returns the nicknames of a GroupMe user in every portal.
+func (nq *NicknameQuery) GetAllByUser(user groupme.ID) []*Nickname {
+	return nq.getAll(getAllNicknamesByUserQuery, user)
+}
+
+func (nq *NicknameQuery) getAll(query string, args ...interface{}) (nicknames []*Nickname) {
+	rows, err := nq.db.Query(query, args...)
+	if err != nil || rows == nil {
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if nickname := nq.New().Scan(rows); nickname != nil {
+			nicknames = append(nicknames, nickname)
+		}
+	}
+	return
+}
+
+// Nickname is the name of a GroupMe user in a single group, which is bridged
+// as their member event displayname in that portal.
+type Nickname struct {
+	db  *Database
+	log log.Logger
+
+	Portal      PortalKey
+	UserGMID    groupme.ID
+	Nickname    string
+	Displayname string
+	NameSet     bool
+	SMS         bool
+}
+
+func (nickname *Nickname) Scan(row dbutil.Scannable) *Nickname {
+	err := row.Scan(&nickname.Portal.GMID, &nickname.Portal.Receiver, &nickname.UserGMID, &nickname.Nickname, &nickname.Displayname, &nickname.NameSet, &nickname.SMS)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			nickname.log.Errorln("Database scan failed:", err)
+		}
+		return nil
+	}
+	return nickname
+}
+
+func (nickname *Nickname) Upsert() {
+	_, err := nickname.db.Exec(upsertNicknameQuery, nickname.Portal.GMID, nickname.Portal.Receiver, nickname.UserGMID, nickname.Nickname, nickname.Displayname, nickname.NameSet, nickname.SMS)
+	if err != nil {
+		nickname.log.Warnfln("Failed to upsert nickname of %s in %s: %v", nickname.UserGMID, nickname.Portal, err)
+	}
+}
+
+func (nickname *Nickname) Delete() {
+	_, err := nickname.db.Exec(deleteNicknameQuery, nickname.Portal.GMID, nickname.Portal.Receiver, nickname.UserGMID)
+	if err != nil {
+		nickname.log.Warnfln("Failed to delete nickname of %s in %s: %v", nickname.UserGMID, nickname.Portal, err)
+	}
+}
@@ -100,7 +100,7 @@ func (pq *PortalQuery) New() *Portal {
 }
 
 const (
-	portalColumns        = "gmid, receiver, mxid, name, name_set, topic, topic_set, avatar, avatar_url, avatar_set, encrypted"
+	portalColumns        = "gmid, receiver, mxid, name, name_set, topic, topic_set, avatar, avatar_url, avatar_set, encrypted, last_message_id, first_event_id, next_batch_id"
 	getAllPortalsQuery   = "SELECT " + portalColumns + " FROM portal"
 	getPortalByGMIDQuery = getAllPortalsQuery + " WHERE gmid=$1 AND receiver=$2"
 	getPortalByMXIDQuery = getAllPortalsQuery + " WHERE mxid=$1"
@@ -163,12 +163,21 @@ type Portal struct {
 	AvatarURL id.ContentURI
 	AvatarSet bool
 	Encrypted bool
+
+	// LastMessageID is the newest GroupMe message that was bridged, which is
+	// where catching up on missed messages starts from.
+	LastMessageID groupme.ID
+
+	// FirstEventID and NextBatchID are where the next batch of history should
+	// be inserted with MSC2716 batch sending.
+	FirstEventID id.EventID
+	NextBatchID  id.BatchID
 }
 
 func (portal *Portal) Scan(row dbutil.Scannable) *Portal {
 	var mxid, avatarURL sql.NullString
 
-	err := row.Scan(&portal.Key.GMID, &portal.Key.Receiver, &mxid, &portal.Name, &portal.NameSet, &portal.Topic, &portal.TopicSet, &portal.Avatar, &avatarURL, &portal.AvatarSet, &portal.Encrypted)
+	err := row.Scan(&portal.Key.GMID, &portal.Key.Receiver, &mxid, &portal.Name, &portal.NameSet, &portal.Topic, &portal.TopicSet, &portal.Avatar, &avatarURL, &portal.AvatarSet, &portal.Encrypted, &portal.LastMessageID, &portal.FirstEventID, &portal.NextBatchID)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			portal.log.Errorln("Database scan failed:", err)
@@ -190,9 +199,9 @@ func (portal *Portal) mxidPtr() *id.RoomID {
 func (portal *Portal) Insert() {
 	_, err := portal.db.Exec(fmt.Sprintf(`
 		INSERT INTO portal (%s)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
 	`, portalColumns),
-		portal.Key.GMID, portal.Key.Receiver, portal.mxidPtr(), portal.Name, portal.NameSet, portal.Topic, portal.TopicSet, portal.Avatar, portal.AvatarURL.String(), portal.AvatarSet, portal.Encrypted)
+		portal.Key.GMID, portal.Key.Receiver, portal.mxidPtr(), portal.Name, portal.NameSet, portal.Topic, portal.TopicSet, portal.Avatar, portal.AvatarURL.String(), portal.AvatarSet, portal.Encrypted, portal.LastMessageID, portal.FirstEventID, portal.NextBatchID)
 	if err != nil {
 		portal.log.Warnfln("Failed to insert %s: %v", portal.Key, err)
 	}
@@ -201,12 +210,14 @@ func (portal *Portal) Insert() {
 func (portal *Portal) Update(txn dbutil.Transaction) {
 	query := `
 		UPDATE portal
-		SET mxid=$1, name=$2, name_set=$3, topic=$4, topic_set=$5, avatar=$6, avatar_url=$7, avatar_set=$8, encrypted=$9
-		WHERE gmid=$10 AND receiver=$11
+		SET mxid=$1, name=$2, name_set=$3, topic=$4, topic_set=$5, avatar=$6, avatar_url=$7, avatar_set=$8, encrypted=$9, last_message_id=$10,
+		    first_event_id=$11, next_batch_id=$12
+		WHERE gmid=$13 AND receiver=$14
 	`
 	args := []interface{}{
 		portal.mxidPtr(), portal.Name, portal.NameSet, portal.Topic, portal.TopicSet, portal.Avatar, portal.AvatarURL.String(),
-		portal.AvatarSet, portal.Encrypted, portal.Key.GMID, portal.Key.Receiver,
+		portal.AvatarSet, portal.Encrypted, portal.LastMessageID, portal.FirstEventID, portal.NextBatchID,
+		portal.Key.GMID, portal.Key.Receiver,
 	}
 	var err error
 	if txn != nil {
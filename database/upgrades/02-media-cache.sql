@@ -0,0 +1,14 @@
+-- v1 -> v2: Add media cache
+
+CREATE TABLE media (
+    url       TEXT PRIMARY KEY,
+    mxc       TEXT    NOT NULL,
+    size      BIGINT  NOT NULL,
+    mime_type TEXT    NOT NULL,
+    file_name TEXT    NOT NULL DEFAULT '',
+    width     INTEGER NOT NULL DEFAULT 0,
+    height    INTEGER NOT NULL DEFAULT 0,
+    duration  INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX media_mxc_idx ON media (mxc);
@@ -0,0 +1,14 @@
+-- v2 -> v3: Store per-group nicknames
+
+CREATE TABLE nickname (
+    portal_gmid     TEXT,
+    portal_receiver TEXT,
+    user_gmid       TEXT,
+    nickname        TEXT    NOT NULL,
+    name_set        BOOLEAN NOT NULL DEFAULT false,
+
+    PRIMARY KEY (portal_gmid, portal_receiver, user_gmid),
+    FOREIGN KEY (portal_gmid, portal_receiver) REFERENCES portal(gmid, receiver) ON DELETE CASCADE
+);
+
+CREATE INDEX nickname_user_idx ON nickname (user_gmid);
@@ -0,0 +1,4 @@
+-- v3 -> v4: Store displaynames and SMS status of group members
+
+ALTER TABLE nickname ADD COLUMN displayname TEXT NOT NULL DEFAULT '';
+ALTER TABLE nickname ADD COLUMN sms BOOLEAN NOT NULL DEFAULT false;
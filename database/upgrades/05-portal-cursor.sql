@@ -0,0 +1,3 @@
+-- v4 -> v5: Store the last bridged message of portals to catch up after reconnects
+
+ALTER TABLE portal ADD COLUMN last_message_id TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,4 @@
+-- v5 -> v6: Store the state of MSC2716 batch sending for portals
+
+ALTER TABLE portal ADD COLUMN first_event_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE portal ADD COLUMN next_batch_id TEXT NOT NULL DEFAULT '';
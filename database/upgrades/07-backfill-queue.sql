@@ -0,0 +1,29 @@
+-- v6 -> v7: Add a persistent queue of backfill tasks
+
+CREATE TABLE backfill_queue (
+    queue_id INTEGER PRIMARY KEY
+        -- only: postgres
+        GENERATED ALWAYS AS IDENTITY
+    ,
+    user_mxid       TEXT    NOT NULL,
+    portal_gmid     TEXT    NOT NULL,
+    portal_receiver TEXT    NOT NULL,
+    type            INTEGER NOT NULL,
+    priority        INTEGER NOT NULL,
+
+    time_start       BIGINT,
+    max_batch_events INTEGER NOT NULL,
+    batch_delay      INTEGER NOT NULL DEFAULT 0,
+    max_total_events INTEGER NOT NULL DEFAULT 0,
+
+    oldest_message_id TEXT    NOT NULL DEFAULT '',
+    backfilled_count  INTEGER NOT NULL DEFAULT 0,
+    attempts          INTEGER NOT NULL DEFAULT 0,
+    next_attempt      BIGINT  NOT NULL DEFAULT 0,
+    completed_at      BIGINT,
+
+    FOREIGN KEY (user_mxid) REFERENCES "user"(mxid) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY (portal_gmid, portal_receiver) REFERENCES portal(gmid, receiver) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE INDEX backfill_queue_portal_idx ON backfill_queue (portal_gmid, portal_receiver);
@@ -0,0 +1,22 @@
+package groupmeext
+
+import (
+	"github.com/beeper/groupme-lib"
+)
+
+// ReadReceipt marks the last message a user has read in a direct message
+// conversation.
+type ReadReceipt struct {
+	ID        groupme.ID        `json:"id"`
+	ChatID    groupme.ID        `json:"chat_id"`
+	MessageID groupme.ID        `json:"message_id"`
+	UserID    groupme.ID        `json:"user_id"`
+	ReadAt    groupme.Timestamp `json:"read_at"`
+}
+
+// Chat is a direct message conversation along with the read receipt of the
+// other user, which groupme-lib doesn't parse.
+type Chat struct {
+	groupme.Chat
+	ReadReceipt *ReadReceipt `json:"read_receipt,omitempty"`
+}
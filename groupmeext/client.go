@@ -1,22 +1,87 @@
 package groupmeext
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 
 	"github.com/beeper/groupme-lib"
 )
 
 type Client struct {
 	*groupme.Client
+
+	token      string
+	httpClient *http.Client
 }
 
 // NewClient creates a new GroupMe API Client
 func NewClient(authToken string) *Client {
 	n := Client{
-		Client: groupme.NewClient(authToken),
+		Client:     groupme.NewClient(authToken),
+		token:      authToken,
+		httpClient: &http.Client{},
 	}
 	return &n
 }
+
+type apiResponse struct {
+	Response json.RawMessage `json:"response"`
+	Meta     groupme.Meta    `json:"meta"`
+}
+
+// request calls API endpoints that groupme-lib doesn't cover (or doesn't
+// return all the fields of). Errors from GroupMe are returned as *groupme.Meta
+// like in groupme-lib.
+func (c *Client) request(ctx context.Context, method, url string, body, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+	if err != nil {
+		return err
+	}
+	if len(c.token) > 0 {
+		req.Header.Set("X-Access-Token", c.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var parsed apiResponse
+	err = json.NewDecoder(resp.Body).Decode(&parsed)
+	if resp.StatusCode >= 300 {
+		if err != nil || parsed.Meta.Code == 0 {
+			parsed.Meta.Code = groupme.HTTPStatusCode(resp.StatusCode)
+		}
+		return &parsed.Meta
+	} else if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	if out != nil && len(parsed.Response) > 0 {
+		return json.Unmarshal(parsed.Response, out)
+	}
+	return nil
+}
+
 func (c Client) IndexAllGroups() ([]*groupme.Group, error) {
 	return c.IndexGroups(context.TODO(), &groupme.GroupsQuery{
 		//	Omit:    "memberships",
@@ -28,27 +93,24 @@ func (c Client) IndexAllRelations() ([]*groupme.User, error) {
 	return c.IndexRelations(context.TODO())
 }
 
-func (c Client) IndexAllChats() ([]*groupme.Chat, error) {
-	return c.IndexChats(context.TODO(), &groupme.IndexChatsQuery{
-		PerPage: 100, //TODO?
-	})
+// IndexAllChats is like IndexChats, but includes the read receipts of the
+// other users.
+func (c *Client) IndexAllChats() ([]*Chat, error) {
+	var chats []*Chat
+	err := c.request(context.TODO(), http.MethodGet, groupme.GroupMeAPIBase+"/chats?per_page=100", nil, &chats) //TODO?
+	return chats, err
+}
+
+// isNotModified checks if GroupMe responded with 304 Not Modified, which is
+// what it does when there are no messages to return.
+func isNotModified(err error) bool {
+	var meta *groupme.Meta
+	return errors.As(err, &meta) && meta.Code == groupme.HTTPNotModified
 }
 
 func (c Client) LoadMessagesAfter(groupID groupme.ID, lastMessageID string, lastMessageFromMe bool, private bool) ([]*groupme.Message, error) {
 	if private {
-		ans, e := c.IndexDirectMessages(context.TODO(), groupID.String(), &groupme.IndexDirectMessagesQuery{
-			SinceID: groupme.ID(lastMessageID),
-			//Limit:    num,
-		})
-		//fmt.Println(groupID, lastMessageID, num, i.Count, e)
-		if e != nil {
-			return nil, e
-		}
-
-		for i, j := 0, len(ans.Messages)-1; i < j; i, j = i+1, j-1 {
-			ans.Messages[i], ans.Messages[j] = ans.Messages[j], ans.Messages[i]
-		}
-		return ans.Messages, nil
+		return c.loadDirectMessagesAfter(groupID, groupme.ID(lastMessageID))
 	} else {
 		i, e := c.IndexMessages(context.TODO(), groupID, &groupme.IndexMessagesQuery{
 			AfterID: groupme.ID(lastMessageID),
@@ -56,7 +118,9 @@ func (c Client) LoadMessagesAfter(groupID groupme.ID, lastMessageID string, last
 			Limit: 20,
 		})
 		//fmt.Println(groupID, lastMessageID, num, i.Count, e)
-		if e != nil {
+		if isNotModified(e) {
+			return nil, nil
+		} else if e != nil {
 			return nil, e
 		}
 		return i.Messages, nil
@@ -65,15 +129,7 @@ func (c Client) LoadMessagesAfter(groupID groupme.ID, lastMessageID string, last
 
 func (c Client) LoadMessagesBefore(groupID, lastMessageID string, private bool) ([]*groupme.Message, error) {
 	if private {
-		i, e := c.IndexDirectMessages(context.TODO(), groupID, &groupme.IndexDirectMessagesQuery{
-			BeforeID: groupme.ID(lastMessageID),
-			//Limit:    num,
-		})
-		//fmt.Println(groupID, lastMessageID, num, i.Count, e)
-		if e != nil {
-			return nil, e
-		}
-		return i.Messages, nil
+		return c.indexDirectMessages(groupme.ID(groupID), groupme.ID(lastMessageID), "")
 	} else {
 		//TODO: limit max 100
 		i, e := c.IndexMessages(context.TODO(), groupme.ID(groupID), &groupme.IndexMessagesQuery{
@@ -82,13 +138,95 @@ func (c Client) LoadMessagesBefore(groupID, lastMessageID string, private bool)
 			Limit: 20,
 		})
 		//fmt.Println(groupID, lastMessageID, num, i.Count, e)
-		if e != nil {
+		if isNotModified(e) {
+			return nil, nil
+		} else if e != nil {
 			return nil, e
 		}
 		return i.Messages, nil
 	}
 }
 
+// directMessagePageSize is the number of messages GroupMe returns per page of
+// direct messages. It can't be changed.
+const directMessagePageSize = 20
+
+// IsNewerMessageID compares GroupMe message IDs, which are increasing numbers.
+func IsNewerMessageID(a, b groupme.ID) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
+
+// indexDirectMessages fetches a page of direct messages with the other user,
+// newest first. groupme-lib sends before_id with the wrong case, which GroupMe
+// ignores, so this uses the endpoint directly.
+func (c *Client) indexDirectMessages(otherUserID, beforeID, sinceID groupme.ID) ([]*groupme.Message, error) {
+	query := url.Values{}
+	query.Set("other_user_id", otherUserID.String())
+	if len(beforeID) > 0 {
+		query.Set("before_id", beforeID.String())
+	}
+	if len(sinceID) > 0 {
+		query.Set("since_id", sinceID.String())
+	}
+	var resp groupme.IndexDirectMessagesResponse
+	err := c.request(context.TODO(), http.MethodGet, groupme.GroupMeAPIBase+"/direct_messages?"+query.Encode(), nil, &resp)
+	if isNotModified(err) {
+		return nil, nil
+	}
+	return resp.Messages, err
+}
+
+// loadDirectMessagesAfter fetches all direct messages with the other user that
+// are newer than lastMessageID in chronological order. GroupMe only returns
+// the newest page for since_id, so this pages back from the newest message
+// until it reaches lastMessageID. If lastMessageID is empty, only the newest
+// page is returned.
+func (c *Client) loadDirectMessagesAfter(otherUserID, lastMessageID groupme.ID) ([]*groupme.Message, error) {
+	var messages []*groupme.Message
+	var before groupme.ID
+	// Only the first request uses since_id, older pages are found with
+	// before_id and cut off at lastMessageID here.
+	since := lastMessageID
+	for {
+		page, err := c.indexDirectMessages(otherUserID, before, since)
+		if err != nil {
+			return nil, err
+		}
+		reachedLast := len(lastMessageID) == 0 || len(page) < directMessagePageSize
+		for _, message := range page {
+			if len(lastMessageID) > 0 && !IsNewerMessageID(message.ID, lastMessageID) {
+				reachedLast = true
+				break
+			}
+			messages = append(messages, message)
+		}
+		if reachedLast {
+			break
+		}
+		before = page[len(page)-1].ID
+		since = ""
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// MarkRead marks a group or direct message conversation as read up to the
+// given message. chatID is either a group ID or a direct message conversation
+// ID. GroupMe doesn't document this endpoint.
+func (c *Client) MarkRead(ctx context.Context, chatID, messageID groupme.ID) error {
+	return c.request(ctx, http.MethodPost, groupme.GroupMeAPIBase+"/read_receipts", map[string]interface{}{
+		"read_receipt": map[string]groupme.ID{
+			"chat_id":    chatID,
+			"message_id": messageID,
+		},
+	}, nil)
+}
+
 func (c *Client) RemoveFromGroup(uid, groupID groupme.ID) error {
 	group, err := c.ShowGroup(context.TODO(), groupID)
 	if err != nil {
@@ -0,0 +1,88 @@
+package groupmeext
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var (
+	ErrMediaNotFound  = errors.New("media not found")
+	ErrUnauthorized   = errors.New("not allowed to download media")
+	ErrMediaTooLarge  = errors.New("file is too large")
+	ErrTransientError = errors.New("temporary error downloading media")
+)
+
+const (
+	downloadRetries    = 3
+	downloadRetryDelay = 2 * time.Second
+)
+
+// downloadClient doesn't have an overall timeout, since large files can take
+// a while to stream. The context passed to the download functions limits
+// the total time instead.
+var downloadClient = &http.Client{
+	Transport: func() http.RoundTripper {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.ResponseHeaderTimeout = 30 * time.Second
+		return transport
+	}(),
+}
+
+func statusError(statusCode int) error {
+	var err error
+	switch {
+	case statusCode == http.StatusNotFound || statusCode == http.StatusGone:
+		err = ErrMediaNotFound
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		err = ErrUnauthorized
+	case statusCode == http.StatusRequestEntityTooLarge:
+		err = ErrMediaTooLarge
+	case statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests || statusCode >= 500:
+		err = ErrTransientError
+	default:
+		return fmt.Errorf("unexpected HTTP status %d", statusCode)
+	}
+	return fmt.Errorf("%w (HTTP %d)", err, statusCode)
+}
+
+// download sends the request made by newRequest and returns the response if
+// it was successful. Network errors and server errors are retried a few times.
+// newRequest is called for every attempt so that request bodies can be reused.
+func download(ctx context.Context, newRequest func(ctx context.Context) (*http.Request, error)) (*http.Response, error) {
+	var err error
+	for attempt := 0; attempt <= downloadRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(time.Duration(attempt) * downloadRetryDelay):
+			}
+		}
+
+		var req *http.Request
+		req, err = newRequest(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var resp *http.Response
+		resp, err = downloadClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			err = fmt.Errorf("%w: %v", ErrTransientError, err)
+			continue
+		} else if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp, nil
+		}
+		_ = resp.Body.Close()
+		err = statusError(resp.StatusCode)
+		if !errors.Is(err, ErrTransientError) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
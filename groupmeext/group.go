@@ -0,0 +1,129 @@
+package groupmeext
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/beeper/groupme-lib"
+)
+
+var ErrInvalidShareURL = errors.New("invalid GroupMe share URL")
+
+// GroupMember is a group member along with their roles, which groupme-lib
+// doesn't parse.
+type GroupMember struct {
+	groupme.Member
+	Roles []string `json:"roles,omitempty"`
+}
+
+// IsAdmin checks if the member is allowed to change the group settings.
+func (m *GroupMember) IsAdmin() bool {
+	for _, role := range m.Roles {
+		if role == "admin" || role == "owner" {
+			return true
+		}
+	}
+	return false
+}
+
+// GroupInfo is a group with the fields that groupme-lib doesn't parse.
+type GroupInfo struct {
+	groupme.Group
+	Members          []*GroupMember `json:"members,omitempty"`
+	MembersCount     int            `json:"members_count,omitempty"`
+	RequiresApproval bool           `json:"requires_approval,omitempty"`
+}
+
+// GetMember finds a member of the group by their user ID.
+func (g *GroupInfo) GetMember(userID groupme.ID) *GroupMember {
+	for _, member := range g.Members {
+		if member.UserID == userID {
+			return member
+		}
+	}
+	return nil
+}
+
+// GetMembersCount returns the number of members, which previews only include
+// as a count.
+func (g *GroupInfo) GetMembersCount() int {
+	if g.MembersCount > 0 {
+		return g.MembersCount
+	}
+	return len(g.Members)
+}
+
+// ParseShareURL extracts the group ID and share token from a group share URL,
+// like https://groupme.com/join_group/<group ID>/<share token>.
+func ParseShareURL(shareURL string) (groupme.ID, string, error) {
+	if !strings.Contains(shareURL, "://") {
+		shareURL = "https://" + shareURL
+	}
+	parsed, err := url.Parse(shareURL)
+	if err != nil || (parsed.Host != "groupme.com" && !strings.HasSuffix(parsed.Host, ".groupme.com")) {
+		return "", "", ErrInvalidShareURL
+	}
+	parts := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	if len(parts) != 3 || parts[0] != "join_group" || len(parts[1]) == 0 || len(parts[2]) == 0 {
+		return "", "", ErrInvalidShareURL
+	}
+	return groupme.ID(parts[1]), parts[2], nil
+}
+
+type groupResponse struct {
+	Group *GroupInfo `json:"group"`
+}
+
+// ShowGroupInfo fetches a group including the roles of its members.
+func (c *Client) ShowGroupInfo(ctx context.Context, groupID groupme.ID) (*GroupInfo, error) {
+	var group GroupInfo
+	err := c.request(ctx, http.MethodGet, fmt.Sprintf("%s/groups/%s", groupme.GroupMeAPIBase, groupID), nil, &group)
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// PreviewGroup fetches the public info of a group from its share token. This
+// is what GroupMe shows before joining a group from a share URL.
+func (c *Client) PreviewGroup(ctx context.Context, groupID groupme.ID, shareToken string) (*GroupInfo, error) {
+	var resp groupResponse
+	err := c.request(ctx, http.MethodGet, fmt.Sprintf("%s/groups/%s/preview/%s", groupme.GroupMeAPIBase, groupID, url.PathEscape(shareToken)), nil, &resp)
+	if err != nil {
+		return nil, err
+	} else if resp.Group == nil {
+		return nil, fmt.Errorf("group preview response didn't contain a group")
+	}
+	return resp.Group, nil
+}
+
+// JoinGroupWithToken joins a group with the token from its share URL. If the
+// group requires approval, this only sends a request to join.
+func (c *Client) JoinGroupWithToken(ctx context.Context, groupID groupme.ID, shareToken string) (*GroupInfo, error) {
+	var resp groupResponse
+	err := c.request(ctx, http.MethodPost, fmt.Sprintf("%s/groups/%s/join/%s", groupme.GroupMeAPIBase, groupID, url.PathEscape(shareToken)), nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Group, nil
+}
+
+// ResetShareURL turns sharing of a group off and on again, which makes GroupMe
+// generate a new share URL and invalidates the old one.
+func (c *Client) ResetShareURL(ctx context.Context, groupID groupme.ID) (string, error) {
+	updateURL := fmt.Sprintf("%s/groups/%s/update", groupme.GroupMeAPIBase, groupID)
+	err := c.request(ctx, http.MethodPost, updateURL, map[string]bool{"share": false}, nil)
+	if err != nil {
+		return "", err
+	}
+	var group GroupInfo
+	err = c.request(ctx, http.MethodPost, updateURL, map[string]bool{"share": true}, &group)
+	if err != nil {
+		return "", err
+	}
+	return group.ShareURL, nil
+}
@@ -0,0 +1,115 @@
+package groupmeext
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/beeper/groupme-lib"
+)
+
+// DefaultLoginBaseURL is the API that the GroupMe web client logs in with.
+const DefaultLoginBaseURL = "https://v2.groupme.com"
+
+const loginAppID = "groupme-web"
+
+const (
+	ChallengeMethodSMS = "sms"
+	ChallengeMethodPIN = "pin"
+)
+
+// LoginChallenge is returned instead of an access token when GroupMe wants the
+// login to be confirmed, either with the user's PIN or with a verification
+// code sent by SMS.
+type LoginChallenge struct {
+	ID     string `json:"id"`
+	Method string `json:"method"`
+	// Hint is the masked phone number an SMS code was sent to.
+	Hint string `json:"hint,omitempty"`
+}
+
+type LoginResult struct {
+	AccessToken string          `json:"access_token,omitempty"`
+	Challenge   *LoginChallenge `json:"verification,omitempty"`
+}
+
+// LoginClient logs in with a username and password to get an access token,
+// and checks access tokens before they're used. The same client has to be
+// used for all steps of a login, as GroupMe ties challenges to the device ID.
+type LoginClient struct {
+	client     *Client
+	baseURL    string
+	apiBaseURL string
+	deviceID   string
+}
+
+// NewLoginClient creates a login client. Empty URLs mean the real GroupMe
+// APIs, other URLs are only useful for testing against a stand-in server.
+func NewLoginClient(baseURL, apiBaseURL string) *LoginClient {
+	if len(baseURL) == 0 {
+		baseURL = DefaultLoginBaseURL
+	}
+	if len(apiBaseURL) == 0 {
+		apiBaseURL = groupme.GroupMeAPIBase
+	}
+	deviceID := make([]byte, 16)
+	_, _ = rand.Read(deviceID)
+	return &LoginClient{
+		client:     NewClient(""),
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		apiBaseURL: strings.TrimSuffix(apiBaseURL, "/"),
+		deviceID:   hex.EncodeToString(deviceID),
+	}
+}
+
+// CheckToken returns the user an access token belongs to. GroupMe answers
+// with HTTPUnauthorized if the token isn't valid.
+func (lc *LoginClient) CheckToken(ctx context.Context, token string) (*groupme.User, error) {
+	var me groupme.User
+	err := NewClient(token).request(ctx, http.MethodGet, lc.apiBaseURL+"/users/me", nil, &me)
+	if err != nil {
+		return nil, err
+	} else if len(me.ID) == 0 {
+		return nil, errors.New("user response didn't contain a user ID")
+	}
+	return &me, nil
+}
+
+// Login sends the user's email address or phone number and password. The
+// result has either an access token or a challenge to answer with Verify.
+func (lc *LoginClient) Login(ctx context.Context, username, password string) (*LoginResult, error) {
+	var result LoginResult
+	err := lc.client.request(ctx, http.MethodPost, lc.baseURL+"/access_tokens", map[string]string{
+		"username":   username,
+		"password":   password,
+		"grant_type": "password",
+		"app_id":     loginAppID,
+		"device_id":  lc.deviceID,
+	}, &result)
+	if err != nil {
+		return nil, err
+	} else if len(result.AccessToken) == 0 && result.Challenge == nil {
+		return nil, errors.New("login response didn't contain an access token or a challenge")
+	}
+	return &result, nil
+}
+
+// Verify answers a login challenge with the PIN or verification code, and
+// returns the access token.
+func (lc *LoginClient) Verify(ctx context.Context, challenge *LoginChallenge, code string) (string, error) {
+	var result LoginResult
+	err := lc.client.request(ctx, http.MethodPost, lc.baseURL+"/access_tokens/verifications/"+url.PathEscape(challenge.ID), map[string]string{
+		"code":      code,
+		"device_id": lc.deviceID,
+	}, &result)
+	if err != nil {
+		return "", err
+	} else if len(result.AccessToken) == 0 {
+		return "", errors.New("verification response didn't contain an access token")
+	}
+	return result.AccessToken, nil
+}
@@ -0,0 +1,151 @@
+package groupmeext
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/beeper/groupme-lib"
+)
+
+const (
+	testToken    = "token"
+	testPassword = "correct horse  battery staple"
+	testPIN      = "1234"
+	testSMSCode  = "567890"
+)
+
+// fakeLoginServer stands in for both the GroupMe login API and the part of
+// the normal API that access tokens are checked against. Logging in as
+// "pin@example.com" or "sms@example.com" requires answering a challenge.
+func fakeLoginServer(t *testing.T) *httptest.Server {
+	var deviceID string
+	respond := func(w http.ResponseWriter, status int, response interface{}) {
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"response": response,
+			"meta":     map[string]int{"code": status},
+		})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if req["password"] != testPassword {
+			respond(w, http.StatusUnauthorized, nil)
+			return
+		}
+		deviceID = req["device_id"]
+		switch req["username"] {
+		case "pin@example.com":
+			respond(w, http.StatusCreated, LoginResult{Challenge: &LoginChallenge{ID: "pin-challenge", Method: ChallengeMethodPIN}})
+		case "sms@example.com":
+			respond(w, http.StatusCreated, LoginResult{Challenge: &LoginChallenge{ID: "sms-challenge", Method: ChallengeMethodSMS, Hint: "***-***-1234"}})
+		default:
+			respond(w, http.StatusCreated, LoginResult{AccessToken: testToken})
+		}
+	})
+	mux.HandleFunc("/access_tokens/verifications/", func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if req["device_id"] != deviceID {
+			t.Errorf("Verification came from device %q instead of %q", req["device_id"], deviceID)
+		}
+		expected := map[string]string{
+			"/access_tokens/verifications/pin-challenge": testPIN,
+			"/access_tokens/verifications/sms-challenge": testSMSCode,
+		}[r.URL.Path]
+		if len(expected) == 0 || req["code"] != expected {
+			respond(w, http.StatusUnauthorized, nil)
+			return
+		}
+		respond(w, http.StatusCreated, LoginResult{AccessToken: testToken})
+	})
+	mux.HandleFunc("/v3/users/me", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Access-Token") != testToken {
+			respond(w, http.StatusUnauthorized, nil)
+			return
+		}
+		respond(w, http.StatusOK, groupme.User{ID: "1", Name: "Alice"})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func isUnauthorized(err error) bool {
+	var meta *groupme.Meta
+	return errors.As(err, &meta) && meta.Code == groupme.HTTPUnauthorized
+}
+
+func TestLoginClient(t *testing.T) {
+	server := fakeLoginServer(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		method   string
+		code     string
+		wantErr  bool
+	}{
+		{name: "token", username: "alice@example.com", password: testPassword},
+		{name: "pin", username: "pin@example.com", password: testPassword, method: ChallengeMethodPIN, code: testPIN},
+		{name: "sms", username: "sms@example.com", password: testPassword, method: ChallengeMethodSMS, code: testSMSCode},
+		{name: "wrong password", username: "alice@example.com", password: "hunter2", wantErr: true},
+		{name: "wrong pin", username: "pin@example.com", password: testPassword, method: ChallengeMethodPIN, code: "0000", wantErr: true},
+		{name: "wrong sms code", username: "sms@example.com", password: testPassword, method: ChallengeMethodSMS, code: testPIN, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lc := NewLoginClient(server.URL, server.URL+"/v3")
+			result, err := lc.Login(ctx, tt.username, tt.password)
+			if len(tt.method) == 0 && tt.wantErr {
+				if !isUnauthorized(err) {
+					t.Fatalf("Login() error = %v, want HTTPUnauthorized", err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("Login() error = %v", err)
+			}
+
+			token := result.AccessToken
+			if len(tt.method) > 0 {
+				if result.Challenge == nil || result.Challenge.Method != tt.method {
+					t.Fatalf("Login() challenge = %+v, want method %q", result.Challenge, tt.method)
+				} else if tt.method == ChallengeMethodSMS && len(result.Challenge.Hint) == 0 {
+					t.Error("SMS challenge has no phone number hint")
+				}
+				token, err = lc.Verify(ctx, result.Challenge, tt.code)
+				if tt.wantErr {
+					if !isUnauthorized(err) {
+						t.Fatalf("Verify() error = %v, want HTTPUnauthorized", err)
+					}
+					return
+				} else if err != nil {
+					t.Fatalf("Verify() error = %v", err)
+				}
+			}
+
+			me, err := lc.CheckToken(ctx, token)
+			if err != nil {
+				t.Fatalf("CheckToken() error = %v", err)
+			} else if me.ID != "1" {
+				t.Errorf("CheckToken() user ID = %q, want 1", me.ID)
+			}
+		})
+	}
+}
+
+func TestLoginClientCheckInvalidToken(t *testing.T) {
+	server := fakeLoginServer(t)
+	lc := NewLoginClient(server.URL, server.URL+"/v3")
+	_, err := lc.CheckToken(context.Background(), "invalid")
+	if !isUnauthorized(err) {
+		t.Fatalf("CheckToken() error = %v, want HTTPUnauthorized", err)
+	}
+}
@@ -2,12 +2,14 @@ package groupmeext
 
 import (
 	"bytes"
+	"context"
 	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
+	"net/url"
 
 	"github.com/beeper/groupme-lib"
 )
@@ -35,89 +37,145 @@ func (m *Message) Value() (driver.Value, error) {
 	return e, nil
 }
 
+// Media is a download of GroupMe media that hasn't been read yet. Size is -1
+// if GroupMe didn't say how large the file is.
+type Media struct {
+	io.ReadCloser
+	Size     int64
+	MimeType string
+	FileName string
+}
+
+func newMedia(resp *http.Response) *Media {
+	return &Media{
+		ReadCloser: resp.Body,
+		Size:       resp.ContentLength,
+		MimeType:   resp.Header.Get("Content-Type"),
+	}
+}
+
 // DownloadImage helper function to download image from groupme;
 // append .large/.preview/.avatar to get various sizes
-func DownloadImage(URL string) (bytes *[]byte, mime string, err error) {
+func DownloadImage(ctx context.Context, URL string) (*Media, error) {
 	//TODO check its actually groupme?
-	response, err := http.Get(URL)
+	resp, err := download(ctx, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, URL, nil)
+	})
 	if err != nil {
-		return nil, "", errors.New("Failed to download avatar: " + err.Error())
+		return nil, fmt.Errorf("failed to download image: %w", err)
 	}
-	defer response.Body.Close()
+	return newMedia(resp), nil
+}
 
-	image, err := ioutil.ReadAll(response.Body)
-	bytes = &image
+// FileURL returns the download URL of a file shared in a group or direct message.
+func FileURL(RoomJID groupme.ID, FileID string) string {
+	return fmt.Sprintf("https://file.groupme.com/v1/%s/files/%s", RoomJID, FileID)
+}
+
+// IsImageURL checks whether the URL is hosted by the GroupMe image service,
+// which means that it can be sent as an image attachment.
+func IsImageURL(URL string) bool {
+	parsed, err := url.Parse(URL)
+	return err == nil && parsed.Host == "i.groupme.com"
+}
+
+// UploadImage uploads an image to the GroupMe image service, which is where
+// group avatars and image attachments have to be hosted, and returns its URL.
+func UploadImage(ctx context.Context, data []byte, mimeType, token string) (string, error) {
+	resp, err := download(ctx, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://image.groupme.com/pictures", bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("X-Access-Token", token)
+		req.Header.Add("Content-Type", mimeType)
+		return req, nil
+	})
 	if err != nil {
-		return nil, "", errors.New("Failed to read downloaded image:" + err.Error())
+		return "", fmt.Errorf("failed to upload image: %w", err)
 	}
-
-	mime = response.Header.Get("Content-Type")
-	if len(mime) == 0 {
-		mime = http.DetectContentType(image)
+	defer resp.Body.Close()
+	var parsed struct {
+		Payload struct {
+			URL string `json:"url"`
+		} `json:"payload"`
 	}
-	return
+	if err = json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return "", fmt.Errorf("failed to parse image upload response: %w", err)
+	} else if !IsImageURL(parsed.Payload.URL) {
+		return "", fmt.Errorf("image service returned unexpected URL %q", parsed.Payload.URL)
+	}
+	return parsed.Payload.URL, nil
 }
 
-func DownloadFile(RoomJID groupme.ID, FileID string, token string) (contents []byte, fname, mime string) {
-	client := &http.Client{}
+// DownloadFile downloads a file shared in a group or direct message, along
+// with its name and MIME type.
+func DownloadFile(ctx context.Context, RoomJID groupme.ID, FileID string, token string) (*Media, error) {
 	b, _ := json.Marshal(struct {
 		FileIDS []string `json:"file_ids"`
 	}{
 		FileIDS: []string{FileID},
 	})
 
-	req, _ := http.NewRequest("POST", fmt.Sprintf("https://file.groupme.com/v1/%s/fileData", RoomJID), bytes.NewReader(b))
-	req.Header.Add("X-Access-Token", token)
-	req.Header.Add("Content-Type", "application/json")
-	resp, err := client.Do(req)
+	resp, err := download(ctx, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("https://file.groupme.com/v1/%s/fileData", RoomJID), bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("X-Access-Token", token)
+		req.Header.Add("Content-Type", "application/json")
+		return req, nil
+	})
 	if err != nil {
-		// TODO: FIX
-		panic(err)
+		return nil, fmt.Errorf("failed to get file info: %w", err)
 	}
-
 	defer resp.Body.Close()
 	data := []ImgData{}
-	json.NewDecoder(resp.Body).Decode(&data)
-	fmt.Println(data, RoomJID, FileID, token)
-	if len(data) < 1 {
-		return
+	if err = json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("failed to parse file info: %w", err)
+	} else if len(data) < 1 {
+		return nil, fmt.Errorf("failed to get file info: %w", ErrMediaNotFound)
 	}
 
-	req, _ = http.NewRequest("POST", fmt.Sprintf("https://file.groupme.com/v1/%s/files/%s", RoomJID, FileID), nil)
-	req.URL.Query().Add("token", token)
-	req.Header.Add("X-Access-Token", token)
-	resp, err = client.Do(req)
+	resp, err = download(ctx, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, FileURL(RoomJID, FileID), nil)
+		if err != nil {
+			return nil, err
+		}
+		query := req.URL.Query()
+		query.Set("token", token)
+		req.URL.RawQuery = query.Encode()
+		req.Header.Add("X-Access-Token", token)
+		return req, nil
+	})
 	if err != nil {
-		// TODO: FIX
-		panic(err)
+		return nil, fmt.Errorf("failed to download file: %w", err)
 	}
-	defer resp.Body.Close()
-
-	bytes, _ := ioutil.ReadAll(resp.Body)
-	return bytes, data[0].FileData.FileName, data[0].FileData.Mime
 
+	media := newMedia(resp)
+	media.FileName = data[0].FileData.FileName
+	media.MimeType = data[0].FileData.Mime
+	if media.Size < 0 {
+		media.Size = int64(data[0].FileData.FileSize)
+	}
+	return media, nil
 }
 
-func DownloadVideo(previewURL, videoURL, token string) (vidContents []byte, mime string) {
-	//preview TODO
-	client := &http.Client{}
-
-	req, _ := http.NewRequest("GET", videoURL, nil)
-	req.AddCookie(&http.Cookie{Name: "token", Value: token})
-	resp, err := client.Do(req)
+// DownloadVideo downloads a video attachment. Its preview_url is a normal
+// GroupMe image and can be downloaded with DownloadImage.
+func DownloadVideo(ctx context.Context, videoURL, token string) (*Media, error) {
+	resp, err := download(ctx, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, videoURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.AddCookie(&http.Cookie{Name: "token", Value: token})
+		return req, nil
+	})
 	if err != nil {
-		fmt.Println(err)
-		return nil, ""
-	}
-	defer resp.Body.Close()
-
-	bytes, _ := ioutil.ReadAll(resp.Body)
-	mime = resp.Header.Get("Content-Type")
-	if len(mime) == 0 {
-		mime = http.DetectContentType(bytes)
+		return nil, fmt.Errorf("failed to download video: %w", err)
 	}
-	return bytes, mime
-
+	return newMedia(resp), nil
 }
 
 type ImgData struct {
@@ -1,6 +1,13 @@
 package groupmeext
 
 import (
+	"encoding/json"
+	"errors"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
 	log "maunium.net/go/maulogger/v2"
 
 	"github.com/karmanyaahm/wray"
@@ -25,34 +32,310 @@ func (f fayeLogger) Infof(i string, a ...interface{}) {
 	f.Logger.Infofln(i, a...)
 }
 
+const directMessageReadType = "direct_message.read"
+
+// ErrClosed is returned when publishing through a closed FayeClient.
+var ErrClosed = errors.New("push client is closed")
+
+func init() {
+	// Read receipts are dispatched by FayeClient, but groupme-lib crashes on
+	// message types it doesn't have a handler for.
+	groupme.RealTimeHandlers[directMessageReadType] = func(*groupme.PushSubscription, string, ...interface{}) {}
+}
+
+// HandlerRead is implemented by push handlers that want direct message read
+// receipts, which groupme-lib doesn't dispatch itself.
+type HandlerRead interface {
+	HandleRead(receipt ReadReceipt)
+}
+
+// HandlerReconnect is implemented by push handlers that want to know when the
+// push connection had to be re-established, as GroupMe doesn't redeliver the
+// messages that were sent while it was down.
+type HandlerReconnect interface {
+	HandleReconnect()
+}
+
 type FayeClient struct {
 	*wray.FayeClient
+
+	log               log.Logger
+	readHandlers      []HandlerRead
+	reconnectHandlers []HandlerReconnect
+
+	lock        sync.RWMutex
+	closed      bool
+	done        chan struct{}
+	clientID    string
+	lastConnect time.Time
+	// calls counts the requests made through this client that are still
+	// running, which closeExt must not stop.
+	calls int
+	// forwarders counts the goroutines passing messages on to msgChannel,
+	// which has to stay open until all of them have stopped.
+	forwarders sync.WaitGroup
+	msgChannel chan groupme.PushMessage
 }
 
-func (fc FayeClient) WaitSubscribe(channel string, msgChannel chan groupme.PushMessage) {
-	c_new := make(chan wray.Message)
-	fc.FayeClient.WaitSubscribe(channel, c_new)
+// pushBuffer is how many messages wray can hand over without waiting for the
+// forwarder. Messages that arrive while the client is closing are dropped,
+// and the buffer keeps wray's delivery goroutines from waiting forever.
+const pushBuffer = 32
+
+func (fc *FayeClient) AddReadHandler(h HandlerRead) {
+	fc.readHandlers = append(fc.readHandlers, h)
+}
+
+func (fc *FayeClient) AddReconnectHandler(h HandlerReconnect) {
+	fc.reconnectHandlers = append(fc.reconnectHandlers, h)
+}
+
+// startCall marks the start of a request made through the client. It returns
+// false if the client has been closed.
+func (fc *FayeClient) startCall() bool {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	if fc.closed {
+		return false
+	}
+	fc.calls++
+	return true
+}
+
+func (fc *FayeClient) endCall() {
+	fc.lock.Lock()
+	fc.calls--
+	fc.lock.Unlock()
+}
+
+func (fc *FayeClient) WaitSubscribe(channel string, msgChannel chan groupme.PushMessage) {
+	if !fc.startCall() {
+		return
+	}
+	defer fc.endCall()
+	fc.lock.Lock()
+	fc.msgChannel = msgChannel
+	fc.forwarders.Add(1)
+	fc.lock.Unlock()
+
+	c_new := make(chan wray.Message, pushBuffer)
 	//converting between types because channels don't support interfaces well
 	go func() {
-		for i := range c_new {
-			msgChannel <- i
+		defer fc.forwarders.Done()
+		for {
+			select {
+			case i := <-c_new:
+				fc.handleRead(i)
+				select {
+				case msgChannel <- i:
+				case <-fc.done:
+					return
+				}
+			case <-fc.done:
+				return
+			}
 		}
 	}()
+	fc.FayeClient.WaitSubscribe(channel, c_new)
+}
+
+// Close stops the listen loop and drops the messages that were still in
+// flight. The message channel passed to WaitSubscribe is closed as well, which
+// stops the groupme-lib goroutine reading from it. A closed client can't be
+// reopened.
+//
+// wray can't be stopped or interrupted, so the listen loop is stopped by
+// closeExt the next time it sends a request, which is after the server answers
+// the connect request it's holding open. The disconnect request sent here
+// makes the server answer it right away.
+func (fc *FayeClient) Close() {
+	fc.lock.Lock()
+	if fc.closed {
+		fc.lock.Unlock()
+		return
+	}
+	fc.closed = true
+	close(fc.done)
+	connected := len(fc.clientID) > 0
+	if connected {
+		fc.calls++
+	}
+	fc.lock.Unlock()
+
+	if connected {
+		go func() {
+			defer fc.endCall()
+			if err := fc.FayeClient.Publish("/meta/disconnect", nil); err != nil {
+				fc.log.Debugln("Failed to send disconnect request:", err)
+			}
+		}()
+	}
+	fc.forwarders.Wait()
+	if fc.msgChannel != nil {
+		close(fc.msgChannel)
+	}
+}
+
+func (fc *FayeClient) IsClosed() bool {
+	fc.lock.RLock()
+	defer fc.lock.RUnlock()
+	return fc.closed
+}
+
+// LastConnect returns when the push server last answered a connect request.
+// GroupMe holds connect requests open until there are messages or it times
+// out, so a working connection answers at least every minute or so.
+func (fc *FayeClient) LastConnect() time.Time {
+	fc.lock.RLock()
+	defer fc.lock.RUnlock()
+	return fc.lastConnect
+}
+
+func (fc *FayeClient) handleRead(msg wray.Message) {
+	data := msg.Data()
+	if msgType, _ := data["type"].(string); msgType != directMessageReadType {
+		return
+	}
+	b, _ := json.Marshal(data["subject"])
+	var receipt ReadReceipt
+	if err := json.Unmarshal(b, &receipt); err != nil {
+		fc.log.Warnln("Failed to parse read receipt:", err)
+		return
+	}
+	for _, h := range fc.readHandlers {
+		h.HandleRead(receipt)
+	}
+}
+
+// SendTyping tells the other members of a group or direct message that userID
+// is typing. chatID is the group ID, or the direct message conversation ID if
+// private is set.
+func (fc *FayeClient) SendTyping(userID, chatID groupme.ID, private bool) error {
+	if !fc.startCall() {
+		return ErrClosed
+	}
+	defer fc.endCall()
+	channel := "/group/" + chatID.String()
+	if private {
+		channel = "/direct_message/" + strings.Replace(chatID.String(), "+", "_", 1)
+	}
+	return fc.Publish(channel, map[string]interface{}{
+		"type":    "typing",
+		"user_id": userID.String(),
+		"started": time.Now().UnixMilli(),
+	})
 }
 
 // for authentication, specific implementation will vary based on faye library
-type AuthExt struct{}
+type AuthExt struct {
+	token string
+}
 
 func (a *AuthExt) In(wray.Message) {}
 func (a *AuthExt) Out(m wray.Message) {
 	groupme.OutMsgProc(m)
+	// groupme-lib only authenticates subscriptions, publishing needs the token too
+	if !strings.HasPrefix(m.Channel(), "/meta/") {
+		ext := m.Ext()
+		ext["access_token"] = a.token
+		ext["timestamp"] = time.Now().Unix()
+	}
+}
+
+// reconnectExt notices when the Faye client handshakes again after the first
+// connection, and notifies the reconnect handlers once the subscriptions have
+// been restored.
+type reconnectExt struct {
+	fc *FayeClient
+
+	lock          sync.Mutex
+	handshaken    bool
+	resubscribing bool
+}
+
+func (r *reconnectExt) In(m wray.Message) {
+	resp, ok := m.(wray.Response)
+	if !ok || !resp.OK() {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	switch m.Channel() {
+	case "/meta/handshake":
+		r.resubscribing = r.handshaken
+		r.handshaken = true
+	case "/meta/subscribe":
+		if r.resubscribing {
+			r.resubscribing = false
+			r.fc.log.Infoln("Push connection was re-established")
+			for _, h := range r.fc.reconnectHandlers {
+				go h.HandleReconnect()
+			}
+		}
+	}
+}
+
+func (r *reconnectExt) Out(wray.Message) {}
+
+// stateExt tracks the client ID and when the push server last answered.
+type stateExt struct {
+	fc *FayeClient
 }
 
-func NewFayeClient(logger log.Logger) *FayeClient {
+func (s *stateExt) In(m wray.Message) {
+	resp, ok := m.(wray.Response)
+	if !ok || !resp.OK() {
+		return
+	}
+	switch m.Channel() {
+	case "/meta/handshake":
+		s.fc.lock.Lock()
+		s.fc.clientID = resp.ClientID()
+		s.fc.lock.Unlock()
+	case "/meta/connect":
+		s.fc.lock.Lock()
+		s.fc.lastConnect = time.Now()
+		s.fc.lock.Unlock()
+	}
+}
+
+func (s *stateExt) Out(wray.Message) {}
+
+// closeExt stops the goroutines of wray that would otherwise keep connecting
+// and retrying forever after the client is closed. Connect requests are only
+// sent by the listen loop, and when no request made through FayeClient is
+// running, any other request must come from one of wray's own retry loops.
+// runtime.Goexit still runs the deferred unlocks of wray's mutexes.
+type closeExt struct {
+	fc *FayeClient
+}
+
+func (c *closeExt) In(wray.Message) {}
+
+func (c *closeExt) Out(m wray.Message) {
+	c.fc.lock.RLock()
+	stop := c.fc.closed && (m.Channel() == "/meta/connect" || c.fc.calls == 0)
+	c.fc.lock.RUnlock()
+	if stop {
+		runtime.Goexit()
+	}
+}
+
+func NewFayeClient(logger log.Logger, token string) *FayeClient {
+	return newFayeClient(logger, token, groupme.PushServer)
+}
 
-	fc := &FayeClient{wray.NewFayeClient(groupme.PushServer)}
-	fc.SetLogger(fayeLogger{logger.Sub("FayeClient")})
-	fc.AddExtension(&AuthExt{})
+func newFayeClient(logger log.Logger, token, pushServer string) *FayeClient {
+	fc := &FayeClient{
+		FayeClient: wray.NewFayeClient(pushServer),
+		log:        logger.Sub("FayeClient"),
+		done:       make(chan struct{}),
+	}
+	fc.SetLogger(fayeLogger{fc.log})
+	fc.AddExtension(&AuthExt{token: token})
+	fc.AddExtension(&reconnectExt{fc: fc})
+	fc.AddExtension(&stateExt{fc: fc})
+	fc.AddExtension(&closeExt{fc: fc})
 	//fc.AddExtension(fc.FayeClient)
 
 	return fc
@@ -0,0 +1,105 @@
+package groupmeext
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"github.com/beeper/groupme-lib"
+)
+
+// fakePushServer answers handshakes and subscriptions, and holds connect
+// requests open like the GroupMe push server does when there are no messages,
+// until the client disconnects.
+type fakePushServer struct {
+	*httptest.Server
+	connecting   chan struct{}
+	disconnected chan struct{}
+}
+
+func newFakePushServer(t *testing.T) *fakePushServer {
+	s := &fakePushServer{
+		connecting:   make(chan struct{}, 1),
+		disconnected: make(chan struct{}),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Channel      string `json:"channel"`
+			Subscription string `json:"subscription"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Failed to decode push request: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp := map[string]interface{}{
+			"channel":    req.Channel,
+			"successful": true,
+			"clientId":   "client",
+		}
+		switch req.Channel {
+		case "/meta/handshake":
+			resp["supportedConnectionTypes"] = []string{"long-polling"}
+		case "/meta/subscribe":
+			resp["subscription"] = req.Subscription
+		case "/meta/connect":
+			select {
+			case s.connecting <- struct{}{}:
+			default:
+			}
+			select {
+			case <-s.disconnected:
+			case <-r.Context().Done():
+				return
+			}
+		case "/meta/disconnect":
+			close(s.disconnected)
+		}
+		_ = json.NewEncoder(w).Encode([]interface{}{resp})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestFayeClientClose(t *testing.T) {
+	server := newFakePushServer(t)
+	fc := newFayeClient(log.DefaultLogger, "token", server.URL)
+	msgChannel := make(chan groupme.PushMessage)
+
+	fc.WaitSubscribe("/user/1", msgChannel)
+	listening := make(chan struct{})
+	go func() {
+		// The listen loop is stopped with runtime.Goexit, so Listen never returns
+		defer close(listening)
+		fc.Listen()
+	}()
+
+	select {
+	case <-server.connecting:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client never sent a connect request")
+	}
+	fc.Close()
+
+	select {
+	case <-listening:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Listen didn't stop after closing the client")
+	}
+	if _, ok := <-msgChannel; ok {
+		t.Error("Message channel wasn't closed")
+	}
+	if !fc.IsClosed() {
+		t.Error("Client isn't marked as closed")
+	}
+
+	// Subscribing after closing must not touch the closed channel
+	fc.WaitSubscribe("/group/1", msgChannel)
+	if err := fc.SendTyping("1", "2", false); err != ErrClosed {
+		t.Errorf("Expected ErrClosed when publishing after closing, got %v", err)
+	}
+}
@@ -1,6 +1,20 @@
 package groupmeext
 
+import (
+	"github.com/beeper/groupme-lib"
+)
+
 const (
 	OldUserSuffix = "@c.groupme.com"
 	NewUserSuffix = "@groupme.com"
 )
+
+// DirectMessageChatID returns the ID GroupMe uses for the direct message
+// conversation between two users: both user IDs joined by a plus sign, lowest
+// ID first.
+func DirectMessageChatID(a, b groupme.ID) groupme.ID {
+	if len(a) > len(b) || (len(a) == len(b) && a > b) {
+		a, b = b, a
+	}
+	return a + "+" + b
+}
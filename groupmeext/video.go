@@ -0,0 +1,177 @@
+package groupmeext
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	ErrInvalidVideo    = errors.New("invalid MP4/QuickTime box")
+	ErrNoVideoMetadata = errors.New("no video metadata found")
+)
+
+// VideoInfo is the metadata of an MP4 or QuickTime video.
+type VideoInfo struct {
+	Width    int
+	Height   int
+	Duration time.Duration
+}
+
+// ParseVideoInfo reads the dimensions and duration of an MP4 or QuickTime
+// (MOV) video. The input is read sequentially without seeking, so it works on
+// streams too, and reading stops as soon as the moov box has been parsed.
+func ParseVideoInfo(r io.Reader) (*VideoInfo, error) {
+	var p videoParser
+	err := p.parseBoxes(r, 0)
+	if err != nil {
+		return nil, err
+	} else if p.info.Width == 0 && p.info.Duration == 0 {
+		return nil, ErrNoVideoMetadata
+	}
+	return &p.info, nil
+}
+
+type videoParser struct {
+	info      VideoInfo
+	foundMoov bool
+}
+
+// readBoxHeader returns the type and payload size of the next box. The size is
+// -1 if the box extends to the end of the input.
+func readBoxHeader(r io.Reader) (boxType string, size int64, err error) {
+	var header [8]byte
+	if _, err = io.ReadFull(r, header[:]); errors.Is(err, io.ErrUnexpectedEOF) {
+		err = ErrInvalidVideo
+		return
+	} else if err != nil {
+		return
+	}
+	boxType = string(header[4:])
+	size = int64(binary.BigEndian.Uint32(header[:4]))
+	switch size {
+	case 0:
+		size = -1
+	case 1:
+		if _, err = io.ReadFull(r, header[:]); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = ErrInvalidVideo
+			return
+		} else if err != nil {
+			return
+		}
+		size = int64(binary.BigEndian.Uint64(header[:])) - 16
+	default:
+		size -= 8
+	}
+	if size < -1 {
+		err = ErrInvalidVideo
+	}
+	return
+}
+
+func (p *videoParser) parseBoxes(r io.Reader, depth int) error {
+	for {
+		boxType, size, err := readBoxHeader(r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		body := r
+		if size >= 0 {
+			body = io.LimitReader(r, size)
+		}
+
+		switch boxType {
+		case "moov", "trak":
+			err = p.parseBoxes(body, depth+1)
+			p.foundMoov = p.foundMoov || boxType == "moov"
+		case "mvhd":
+			err = p.parseMovieHeader(body)
+		case "tkhd":
+			err = p.parseTrackHeader(body)
+		}
+		if err != nil {
+			return err
+		} else if depth == 0 && p.foundMoov {
+			return nil
+		}
+
+		// Skip whatever is left of the box
+		if _, err = io.Copy(io.Discard, body); err != nil {
+			return err
+		} else if size < 0 {
+			return nil
+		}
+	}
+}
+
+func (p *videoParser) parseMovieHeader(r io.Reader) error {
+	var buf [28]byte
+	if _, err := io.ReadFull(r, buf[:4]); err != nil {
+		return ErrInvalidVideo
+	}
+	var timescale uint32
+	var duration uint64
+	if version := buf[0]; version == 1 {
+		// 8 byte creation and modification times, 4 byte timescale, 8 byte duration
+		if _, err := io.ReadFull(r, buf[:28]); err != nil {
+			return ErrInvalidVideo
+		}
+		timescale = binary.BigEndian.Uint32(buf[16:20])
+		duration = binary.BigEndian.Uint64(buf[20:28])
+		if duration == 1<<64-1 {
+			duration = 0
+		}
+	} else {
+		// 4 byte creation and modification times, 4 byte timescale, 4 byte duration
+		if _, err := io.ReadFull(r, buf[:16]); err != nil {
+			return ErrInvalidVideo
+		}
+		timescale = binary.BigEndian.Uint32(buf[8:12])
+		duration = uint64(binary.BigEndian.Uint32(buf[12:16]))
+		if duration == 1<<32-1 {
+			duration = 0
+		}
+	}
+	if timescale > 0 {
+		p.info.Duration = time.Duration(float64(duration) / float64(timescale) * float64(time.Second))
+	}
+	return nil
+}
+
+func (p *videoParser) parseTrackHeader(r io.Reader) error {
+	var buf [60]byte
+	if _, err := io.ReadFull(r, buf[:4]); err != nil {
+		return ErrInvalidVideo
+	}
+	// Skip creation and modification times, track ID and duration
+	skip := 20
+	if version := buf[0]; version == 1 {
+		skip = 32
+	}
+	if _, err := io.ReadFull(r, buf[:skip]); err != nil {
+		return ErrInvalidVideo
+	}
+	// 8 reserved bytes, layer, alternate group, volume, 2 reserved bytes,
+	// a 3x3 transformation matrix and 16.16 fixed point width and height.
+	if _, err := io.ReadFull(r, buf[:60]); err != nil {
+		return ErrInvalidVideo
+	}
+	width := int(binary.BigEndian.Uint32(buf[52:56]) >> 16)
+	height := int(binary.BigEndian.Uint32(buf[56:60]) >> 16)
+	// Audio tracks have no dimensions, and only the first video track matters
+	if width == 0 || height == 0 || p.info.Width != 0 {
+		return nil
+	}
+	matrix := buf[16:52]
+	a := binary.BigEndian.Uint32(matrix[0:4])
+	d := binary.BigEndian.Uint32(matrix[16:20])
+	if a == 0 && d == 0 {
+		// Rotated by 90 or 270 degrees
+		width, height = height, width
+	}
+	p.info.Width, p.info.Height = width, height
+	return nil
+}
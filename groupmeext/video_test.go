@@ -0,0 +1,171 @@
+package groupmeext
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+func box(boxType string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	out := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	return append(append(out, boxType...), body...)
+}
+
+// sizedBox builds a box with an arbitrary size field, for boxes that claim to
+// be larger than they are.
+func sizedBox(boxType string, size uint32, payload []byte) []byte {
+	out := binary.BigEndian.AppendUint32(nil, size)
+	return append(append(out, boxType...), payload...)
+}
+
+func largeBox(boxType string, payload []byte) []byte {
+	out := binary.BigEndian.AppendUint32(nil, 1)
+	out = append(out, boxType...)
+	out = binary.BigEndian.AppendUint64(out, uint64(16+len(payload)))
+	return append(out, payload...)
+}
+
+func mvhd(version byte, timescale uint32, duration uint64) []byte {
+	payload := []byte{version, 0, 0, 0}
+	if version == 1 {
+		payload = append(payload, make([]byte, 16)...)
+		payload = binary.BigEndian.AppendUint32(payload, timescale)
+		payload = binary.BigEndian.AppendUint64(payload, duration)
+	} else {
+		payload = append(payload, make([]byte, 8)...)
+		payload = binary.BigEndian.AppendUint32(payload, timescale)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(duration))
+	}
+	// Rate, volume, matrix and other fields that aren't read
+	return box("mvhd", payload, make([]byte, 80))
+}
+
+func tkhd(version byte, width, height uint32, rotated bool) []byte {
+	payload := []byte{version, 0, 0, 0}
+	if version == 1 {
+		payload = append(payload, make([]byte, 32)...)
+	} else {
+		payload = append(payload, make([]byte, 20)...)
+	}
+	payload = append(payload, make([]byte, 16)...)
+	var a, b, c, d uint32 = 0x10000, 0, 0, 0x10000
+	if rotated {
+		a, b, c, d = 0, 0x10000, 0xffff0000, 0
+	}
+	for _, v := range []uint32{a, b, 0, c, d, 0, 0, 0, 0x40000000} {
+		payload = binary.BigEndian.AppendUint32(payload, v)
+	}
+	payload = binary.BigEndian.AppendUint32(payload, width<<16)
+	payload = binary.BigEndian.AppendUint32(payload, height<<16)
+	return box("tkhd", payload)
+}
+
+func TestParseVideoInfo(t *testing.T) {
+	ftyp := box("ftyp", []byte("isom\x00\x00\x02\x00isomiso2mp41"))
+	mdat := box("mdat", make([]byte, 1024))
+	fiveSeconds := mvhd(0, 1000, 5000)
+	video := box("trak", tkhd(0, 640, 480, false))
+	audio := box("trak", tkhd(0, 0, 0, false))
+
+	tests := []struct {
+		name    string
+		input   []byte
+		want    *VideoInfo
+		wantErr error
+	}{{
+		name:  "mp4",
+		input: bytes.Join([][]byte{ftyp, box("moov", fiveSeconds, video), mdat}, nil),
+		want:  &VideoInfo{Width: 640, Height: 480, Duration: 5 * time.Second},
+	}, {
+		name:  "moov after mdat",
+		input: bytes.Join([][]byte{ftyp, mdat, box("moov", fiveSeconds, video)}, nil),
+		want:  &VideoInfo{Width: 640, Height: 480, Duration: 5 * time.Second},
+	}, {
+		name:  "version 1 headers",
+		input: box("moov", mvhd(1, 600, 900), box("trak", tkhd(1, 1920, 1080, false))),
+		want:  &VideoInfo{Width: 1920, Height: 1080, Duration: 1500 * time.Millisecond},
+	}, {
+		name:  "rotated",
+		input: box("moov", fiveSeconds, box("trak", tkhd(0, 1920, 1080, true))),
+		want:  &VideoInfo{Width: 1080, Height: 1920, Duration: 5 * time.Second},
+	}, {
+		name:  "audio track first",
+		input: box("moov", fiveSeconds, audio, video),
+		want:  &VideoInfo{Width: 640, Height: 480, Duration: 5 * time.Second},
+	}, {
+		name:  "unknown duration",
+		input: box("moov", mvhd(0, 1000, 1<<32-1), video),
+		want:  &VideoInfo{Width: 640, Height: 480},
+	}, {
+		name:  "64-bit box size",
+		input: bytes.Join([][]byte{ftyp, largeBox("mdat", make([]byte, 64)), box("moov", fiveSeconds, video)}, nil),
+		want:  &VideoInfo{Width: 640, Height: 480, Duration: 5 * time.Second},
+	}, {
+		name:  "box extending to end of input",
+		input: append(ftyp, sizedBox("moov", 0, bytes.Join([][]byte{fiveSeconds, video}, nil))...),
+		want:  &VideoInfo{Width: 640, Height: 480, Duration: 5 * time.Second},
+	}, {
+		name:  "oversized moov",
+		input: sizedBox("moov", 1<<20, bytes.Join([][]byte{fiveSeconds, video}, nil)),
+		want:  &VideoInfo{Width: 640, Height: 480, Duration: 5 * time.Second},
+	}, {
+		name:    "oversized mdat",
+		input:   append(ftyp, sizedBox("mdat", 1<<20, make([]byte, 64))...),
+		wantErr: ErrNoVideoMetadata,
+	}, {
+		name:    "no moov",
+		input:   bytes.Join([][]byte{ftyp, mdat}, nil),
+		wantErr: ErrNoVideoMetadata,
+	}, {
+		name:    "empty",
+		input:   nil,
+		wantErr: ErrNoVideoMetadata,
+	}, {
+		name:    "truncated box header",
+		input:   append(ftyp, 0, 0, 0),
+		wantErr: ErrInvalidVideo,
+	}, {
+		name:    "truncated 64-bit box size",
+		input:   append(ftyp, largeBox("mdat", nil)[:12]...),
+		wantErr: ErrInvalidVideo,
+	}, {
+		name:    "truncated mvhd",
+		input:   box("moov", fiveSeconds[:20]),
+		wantErr: ErrInvalidVideo,
+	}, {
+		name:    "truncated tkhd",
+		input:   box("moov", fiveSeconds, box("trak", tkhd(0, 640, 480, false)[:50])),
+		wantErr: ErrInvalidVideo,
+	}, {
+		name:    "oversized tkhd",
+		input:   box("moov", fiveSeconds, box("trak", sizedBox("tkhd", 1<<20, tkhd(0, 640, 480, false)[8:60]))),
+		wantErr: ErrInvalidVideo,
+	}, {
+		name:    "box smaller than its header",
+		input:   sizedBox("moov", 4, nil),
+		wantErr: ErrInvalidVideo,
+	}, {
+		name: "64-bit box size smaller than its header",
+		input: append(binary.BigEndian.AppendUint64(append(binary.BigEndian.AppendUint32(nil, 1), "mdat"...), 8),
+			make([]byte, 16)...),
+		wantErr: ErrInvalidVideo,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info, err := ParseVideoInfo(bytes.NewReader(test.input))
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("expected error %v, got %v (info %+v)", test.wantErr, err, info)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if *info != *test.want {
+				t.Errorf("expected %+v, got %+v", *test.want, *info)
+			}
+		})
+	}
+}
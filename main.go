@@ -51,6 +51,8 @@ type GMBridge struct {
 	Provisioning *ProvisioningAPI
 	Metrics      *MetricsHandler
 
+	BackfillQueue *BackfillQueue
+
 	usersByMXID         map[id.UserID]*User
 	usersByGMID         map[groupme.ID]*User
 	usersLock           sync.Mutex
@@ -89,6 +91,8 @@ func (br *GMBridge) Init() {
 		br.Provisioning = &ProvisioningAPI{bridge: br}
 	}
 
+	br.BackfillQueue = NewBackfillQueue(br)
+
 	br.Metrics = NewMetricsHandler(br.Config.Metrics.Listen, br.Log.Sub("Metrics"), br.DB)
 	br.MatrixHandler.TrackEventDuration = br.Metrics.TrackMatrixEvent
 }
@@ -99,6 +103,9 @@ func (br *GMBridge) Start() {
 		br.Provisioning.Init()
 	}
 	go br.StartUsers()
+	if br.Config.Bridge.HistorySync.Backfill {
+		br.BackfillQueue.Start()
+	}
 	if br.Config.Metrics.Enabled {
 		go br.Metrics.Start()
 	}
@@ -130,12 +137,12 @@ func (br *GMBridge) StartUsers() {
 
 func (br *GMBridge) Stop() {
 	br.Metrics.Stop()
-	// TODO anything needed to disconnect the users?
 	for _, user := range br.usersByGMID {
-		if user.Client == nil {
+		if !user.IsConnected() {
 			continue
 		}
 		br.Log.Debugln("Disconnecting", user.MXID)
+		user.Disconnect()
 	}
 }
 
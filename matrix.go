@@ -24,14 +24,20 @@ import (
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/format"
 	"maunium.net/go/mautrix/id"
-
-	"github.com/beeper/groupme/database"
 )
 
 func (br *GMBridge) CreatePrivatePortal(roomID id.RoomID, brInviter bridge.User, brGhost bridge.Ghost) {
 	inviter := brInviter.(*User)
 	puppet := brGhost.(*Puppet)
-	key := database.NewPortalKey(puppet.GMID, inviter.GMID)
+	intent := puppet.DefaultIntent()
+	if !inviter.CanMessage(puppet.GMID) {
+		br.Log.Debugfln("Rejecting private chat invite from %s to %s: they can't message each other on GroupMe", inviter.MXID, puppet.MXID)
+		reason := "You can only start private chats with GroupMe users you share a group with or have as a contact"
+		_, _ = intent.SendNotice(roomID, reason)
+		_, _ = intent.LeaveRoom(roomID, &mautrix.ReqLeave{Reason: reason})
+		return
+	}
+	key := inviter.PortalKey(puppet.GMID)
 	portal := br.GetPortalByGMID(key)
 
 	if len(portal.MXID) == 0 {
@@ -45,7 +51,6 @@ func (br *GMBridge) CreatePrivatePortal(roomID id.RoomID, brInviter bridge.User,
 		br.createPrivatePortalFromInvite(roomID, inviter, puppet, portal)
 		return
 	}
-	intent := puppet.DefaultIntent()
 	errorMessage := fmt.Sprintf("You already have a private chat portal with me at [%[1]s](https://matrix.to/#/%[1]s)", portal.MXID)
 	errorContent := format.RenderMarkdown(errorMessage, true, false)
 	_, _ = intent.SendMessageEvent(roomID, event.EventMessage, errorContent)
@@ -63,7 +68,22 @@ func (br *GMBridge) createPrivatePortalFromInvite(roomID id.RoomID, inviter *Use
 	} else {
 		encryptionEnabled = existingEncryption.Algorithm == id.AlgorithmMegolmV1
 	}
+	// The portal might be moving from an old room that the user can't be
+	// invited to. Backfills that were queued for the old room are dropped, as
+	// history can't be inserted into the new one.
+	if len(portal.MXID) > 0 {
+		br.DB.Backfill.CompleteAllForPortal(inviter.MXID, portal.Key)
+	}
+	br.portalsLock.Lock()
+	if len(portal.MXID) > 0 {
+		delete(br.portalsByMXID, portal.MXID)
+	}
 	portal.MXID = roomID
+	portal.FirstEventID = ""
+	portal.NextBatchID = ""
+	br.portalsByMXID[portal.MXID] = portal
+	br.portalsLock.Unlock()
+	portal.Topic = "GroupMe private chat"
 	_, _ = portal.MainIntent().SetRoomTopic(portal.MXID, portal.Topic)
 	if portal.bridge.Config.Bridge.PrivateChatPortalMeta || br.Config.Bridge.Encryption.Default || encryptionEnabled {
 		portal.Name = puppet.Displayname
@@ -99,5 +119,15 @@ func (br *GMBridge) createPrivatePortalFromInvite(roomID id.RoomID, inviter *Use
 	}
 	portal.Update(nil)
 	portal.UpdateBridgeInfo()
-	_, _ = intent.SendNotice(roomID, "Private chat portal created")
+	// History can't be batch sent into rooms that weren't created by the
+	// bridge, so only new messages are bridged into adopted rooms.
+	if br.Config.Bridge.HistorySync.Backfill {
+		_, _ = intent.SendNotice(roomID, "Private chat portal created. Chat history isn't available in rooms created "+
+			"on Matrix, so only new messages will be bridged here.")
+	} else {
+		_, _ = intent.SendNotice(roomID, "Private chat portal created")
+	}
+
+	portal.Sync(inviter, nil)
+	inviter.UpdateDirectChats(map[id.UserID][]id.RoomID{puppet.MXID: {roomID}})
 }
@@ -0,0 +1,360 @@
+// mautrix-groupme - A Matrix-GroupMe puppeting bridge.
+// Copyright (C) 2022 Sumner Evans, Karmanyaah Malhotra
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/crypto/attachment"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/groupme/groupmeext"
+)
+
+const megabyte = 1024 * 1024
+
+// mediaTimeout limits how long downloading and reuploading a single file can
+// take, as stalled downloads would otherwise block the portal forever.
+const mediaTimeout = 10 * time.Minute
+
+// mediaInspector reads metadata like dimensions from media while it's being
+// uploaded. It doesn't have to consume the whole reader.
+type mediaInspector func(r io.Reader, info *event.FileInfo)
+
+func (portal *Portal) getMediaInspector(mimeType string) mediaInspector {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return inspectImage
+	case strings.HasPrefix(mimeType, "video/"):
+		return portal.inspectVideo
+	default:
+		return nil
+	}
+}
+
+func inspectImage(r io.Reader, info *event.FileInfo) {
+	cfg, _, err := image.DecodeConfig(r)
+	if err == nil {
+		info.Width, info.Height = cfg.Width, cfg.Height
+	}
+}
+
+func (portal *Portal) inspectVideo(r io.Reader, info *event.FileInfo) {
+	videoInfo, err := groupmeext.ParseVideoInfo(r)
+	if err != nil {
+		portal.log.Debugln("Failed to read video metadata:", err)
+		return
+	}
+	info.Width = videoInfo.Width
+	info.Height = videoInfo.Height
+	info.Duration = int(videoInfo.Duration.Milliseconds())
+}
+
+func tooLargeError(size, limit int64) error {
+	if size < 0 {
+		return fmt.Errorf("%w (the limit is %d MB)", groupmeext.ErrMediaTooLarge, limit/megabyte)
+	}
+	return fmt.Errorf("%w (%.1f MB, the limit is %d MB)", groupmeext.ErrMediaTooLarge, float64(size)/megabyte, limit/megabyte)
+}
+
+// mediaFailureNotice describes why media couldn't be bridged in a way that
+// makes sense to the user.
+func mediaFailureNotice(err error) string {
+	switch {
+	case errors.Is(err, groupmeext.ErrMediaTooLarge):
+		return fmt.Sprintf("Failed to bridge media: %v", err)
+	case errors.Is(err, groupmeext.ErrMediaNotFound):
+		return "Failed to bridge media: it's no longer available on GroupMe"
+	case errors.Is(err, groupmeext.ErrUnauthorized):
+		return "Failed to bridge media: GroupMe didn't allow downloading it"
+	case errors.Is(err, groupmeext.ErrTransientError), errors.Is(err, context.DeadlineExceeded):
+		return "Failed to bridge media: GroupMe didn't respond in time, open the message in GroupMe to see it"
+	default:
+		return "Failed to bridge media"
+	}
+}
+
+// limitedReader is like io.LimitedReader, but fails with ErrMediaTooLarge
+// instead of silently truncating the data.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+	limit     int64
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if lr.remaining <= 0 {
+		var b [1]byte
+		n, err := lr.r.Read(b[:])
+		if n > 0 {
+			return 0, tooLargeError(-1, lr.limit)
+		}
+		return 0, err
+	}
+	if int64(len(p)) > lr.remaining {
+		p = p[:lr.remaining]
+	}
+	n, err := lr.r.Read(p)
+	lr.remaining -= int64(n)
+	return n, err
+}
+
+// spoolMedia copies media of unknown size into a temporary file, as the
+// homeserver needs to know the size before the upload starts.
+func spoolMedia(r io.Reader, limit int64) (*os.File, int64, error) {
+	if limit >= 0 {
+		r = &limitedReader{r: r, remaining: limit, limit: limit}
+	}
+	file, err := os.CreateTemp("", "mautrix-groupme-media-*")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	size, err := io.Copy(file, r)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		if !errors.Is(err, groupmeext.ErrMediaTooLarge) {
+			err = fmt.Errorf("failed to download media: %w", err)
+		}
+		return nil, 0, err
+	}
+	return file, size, nil
+}
+
+// uploadWithContext is like IntentAPI.UploadMedia, but the request is cancelled
+// along with ctx, so that the media timeout also covers the upload.
+func uploadWithContext(ctx context.Context, intent *appservice.IntentAPI, req mautrix.ReqUploadMedia) (*mautrix.RespMediaUpload, error) {
+	var headers http.Header
+	if len(req.ContentType) > 0 {
+		headers = http.Header{"Content-Type": []string{req.ContentType}}
+	}
+	var resp mautrix.RespMediaUpload
+	_, err := intent.MakeFullRequest(mautrix.FullRequest{
+		Method:        http.MethodPost,
+		URL:           intent.BuildURL(mautrix.MediaURLPath{"v3", "upload"}),
+		Headers:       headers,
+		RequestBytes:  req.ContentBytes,
+		RequestBody:   req.Content,
+		RequestLength: req.ContentLength,
+		ResponseJSON:  &resp,
+		Context:       ctx,
+	})
+	return &resp, err
+}
+
+// bridgeMedia fills in content with the GroupMe media at url. Unencrypted
+// portals reuse earlier uploads of the same media, as encrypted files can't be
+// shared between rooms.
+func (portal *Portal) bridgeMedia(ctx context.Context, intent *appservice.IntentAPI, url string, download func() (*groupmeext.Media, error), content *event.MessageEventContent) error {
+	if content.Info == nil {
+		content.Info = &event.FileInfo{}
+	}
+	if !portal.Encrypted {
+		if cached := portal.bridge.DB.Media.GetByURL(url); cached != nil {
+			content.URL = cached.MXC.CUString()
+			if cached.FileName != "" {
+				content.Body = cached.FileName
+			}
+			content.Info.Size = int(cached.Size)
+			content.Info.MimeType = cached.MimeType
+			content.Info.Width = cached.Width
+			content.Info.Height = cached.Height
+			content.Info.Duration = cached.Duration
+			return nil
+		}
+	}
+
+	media, err := download()
+	if err != nil {
+		return err
+	}
+	err = portal.uploadMedia(ctx, intent, media, content)
+	if err != nil {
+		return err
+	}
+	if !portal.Encrypted {
+		mxc, _ := content.URL.Parse()
+		portal.bridge.cacheMedia(url, mxc, content.Body, content.Info)
+	}
+	return nil
+}
+
+func (bridge *GMBridge) cacheMedia(url string, mxc id.ContentURI, fileName string, info *event.FileInfo) {
+	cached := bridge.DB.Media.New()
+	cached.URL = url
+	cached.MXC = mxc
+	cached.FileName = fileName
+	cached.Size = int64(info.Size)
+	cached.MimeType = info.MimeType
+	cached.Width = info.Width
+	cached.Height = info.Height
+	cached.Duration = info.Duration
+	cached.Upsert()
+}
+
+// uploadAvatar uploads a GroupMe avatar in the given size (e.g. ".large"), or
+// returns the earlier upload of it. Avatars are never encrypted, so they're
+// always cached.
+func (bridge *GMBridge) uploadAvatar(intent *appservice.IntentAPI, avatar, size string) (id.ContentURI, error) {
+	url := avatar + size
+	if cached := bridge.DB.Media.GetByURL(url); cached != nil {
+		return cached.MXC, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mediaTimeout)
+	defer cancel()
+	media, err := groupmeext.DownloadImage(ctx, url)
+	if err != nil {
+		return id.ContentURI{}, err
+	}
+	defer media.Close()
+	data, err := io.ReadAll(media)
+	if err != nil {
+		return id.ContentURI{}, fmt.Errorf("failed to read downloaded avatar: %w", err)
+	}
+	info := &event.FileInfo{
+		Size:     len(data),
+		MimeType: media.MimeType,
+	}
+	if len(info.MimeType) == 0 {
+		info.MimeType = http.DetectContentType(data)
+	}
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		info.Width, info.Height = cfg.Width, cfg.Height
+	}
+	resp, err := uploadWithContext(ctx, intent, mautrix.ReqUploadMedia{
+		ContentBytes: data,
+		ContentType:  info.MimeType,
+	})
+	if err != nil {
+		return id.ContentURI{}, fmt.Errorf("failed to upload avatar: %w", err)
+	}
+	bridge.cacheMedia(url, resp.ContentURI, "", info)
+	return resp.ContentURI, nil
+}
+
+// uploadMedia streams media from GroupMe to the homeserver, encrypting it on
+// the way if the portal is encrypted. The URL or file and the info of content
+// are filled in, and images and videos are inspected for their dimensions in
+// parallel with the upload.
+func (portal *Portal) uploadMedia(ctx context.Context, intent *appservice.IntentAPI, media *groupmeext.Media, content *event.MessageEventContent) error {
+	defer media.Close()
+	if content.Info == nil {
+		content.Info = &event.FileInfo{}
+	}
+	maxSize := portal.bridge.Config.Bridge.MaxMediaBytes()
+	if maxSize >= 0 && media.Size > maxSize {
+		return tooLargeError(media.Size, maxSize)
+	}
+
+	var reader io.Reader = media
+	size := media.Size
+	if size < 0 {
+		spooled, spooledSize, err := spoolMedia(media, maxSize)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = spooled.Close()
+			_ = os.Remove(spooled.Name())
+		}()
+		reader, size = spooled, spooledSize
+	}
+
+	buffered := bufio.NewReader(reader)
+	reader = buffered
+	if content.Info.MimeType == "" {
+		content.Info.MimeType = media.MimeType
+	}
+	if content.Info.MimeType == "" {
+		header, _ := buffered.Peek(3072)
+		content.Info.MimeType = mimetype.Detect(header).String()
+	}
+
+	var inspectWriter *io.PipeWriter
+	inspectDone := make(chan struct{})
+	if inspect := portal.getMediaInspector(content.Info.MimeType); inspect != nil {
+		var inspectReader *io.PipeReader
+		inspectReader, inspectWriter = io.Pipe()
+		reader = io.TeeReader(reader, inspectWriter)
+		go func() {
+			defer close(inspectDone)
+			inspect(inspectReader, content.Info)
+			// Keep consuming the data so that the upload doesn't get stuck
+			_, _ = io.Copy(io.Discard, inspectReader)
+		}()
+	} else {
+		close(inspectDone)
+	}
+
+	uploadMimeType := content.Info.MimeType
+	var encrypting io.ReadCloser
+	if portal.Encrypted {
+		content.File = &event.EncryptedFileInfo{EncryptedFile: *attachment.NewEncryptedFile()}
+		encrypting = content.File.EncryptStream(reader)
+		reader = encrypting
+		uploadMimeType = "application/octet-stream"
+	}
+
+	uploaded, err := uploadWithContext(ctx, intent, mautrix.ReqUploadMedia{
+		Content:       reader,
+		ContentLength: size,
+		ContentType:   uploadMimeType,
+	})
+	if encrypting != nil {
+		// Closing the encrypting reader is what fills in the hash of the file
+		_ = encrypting.Close()
+	}
+	if inspectWriter != nil {
+		_ = inspectWriter.CloseWithError(err)
+	}
+	<-inspectDone
+	if err != nil {
+		var httpErr mautrix.HTTPError
+		if errors.Is(err, mautrix.MTooLarge) {
+			return fmt.Errorf("%w: the homeserver rejected it", groupmeext.ErrMediaTooLarge)
+		} else if errors.As(err, &httpErr) && httpErr.IsStatus(413) {
+			return fmt.Errorf("%w: the proxy rejected it", groupmeext.ErrMediaTooLarge)
+		}
+		return fmt.Errorf("failed to upload media: %w", err)
+	}
+
+	content.Info.Size = int(size)
+	if content.File != nil {
+		content.File.URL = uploaded.ContentURI.CUString()
+	} else {
+		content.URL = uploaded.ContentURI.CUString()
+	}
+	return nil
+}
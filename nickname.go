@@ -0,0 +1,162 @@
+// mautrix-groupme - A Matrix-GroupMe puppeting bridge.
+// Copyright (C) 2022 Sumner Evans, Karmanyaah Malhotra
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/beeper/groupme-lib"
+
+	"maunium.net/go/mautrix/event"
+
+	"github.com/beeper/groupme/config"
+	"github.com/beeper/groupme/database"
+)
+
+// GroupMe nicknames are per group, so they can't be used as the global
+// displayname of puppets. Instead, they're set as the displayname in the
+// member event of the puppet in each group portal.
+
+func normalizeNickname(nickname string) string {
+	return strings.ToLower(strings.TrimSpace(nickname))
+}
+
+// UpdateNickname sets the displayname of the puppet in a group portal to its
+// nickname in that group.
+func (puppet *Puppet) UpdateNickname(portal *Portal, nickname string) {
+	if len(portal.MXID) == 0 || portal.IsPrivateChat() {
+		return
+	}
+	portal.nicknameLock.Lock()
+	defer portal.nicknameLock.Unlock()
+
+	stored := puppet.bridge.DB.Nickname.Get(portal.Key, puppet.GMID)
+	var oldNickname string
+	if stored == nil {
+		stored = puppet.bridge.DB.Nickname.New()
+		stored.Portal = portal.Key
+		stored.UserGMID = puppet.GMID
+	} else if stored.Nickname == nickname && stored.NameSet {
+		return
+	} else {
+		oldNickname = normalizeNickname(stored.Nickname)
+	}
+	stored.Nickname = nickname
+	stored.Upsert()
+
+	// Members with the old or new nickname might need to be disambiguated
+	// differently now too.
+	newNickname := normalizeNickname(nickname)
+	portal.syncDisplaynames(false, func(n *database.Nickname) bool {
+		normalized := normalizeNickname(n.Nickname)
+		return n.UserGMID == puppet.GMID || normalized == oldNickname || normalized == newNickname
+	})
+}
+
+// syncNicknames stores the nicknames of all members of a group and updates
+// the displaynames that changed. Members who aren't in the group anymore are
+// forgotten, so that they don't cause collisions.
+func (portal *Portal) syncNicknames(members []*groupme.Member) {
+	if len(portal.MXID) == 0 || portal.IsPrivateChat() {
+		return
+	}
+	portal.nicknameLock.Lock()
+	defer portal.nicknameLock.Unlock()
+
+	existing := make(map[groupme.ID]*database.Nickname)
+	for _, nickname := range portal.bridge.DB.Nickname.GetAllByPortal(portal.Key) {
+		existing[nickname.UserGMID] = nickname
+	}
+	for _, member := range members {
+		sms := !member.AppInstalled
+		stored, ok := existing[member.UserID]
+		delete(existing, member.UserID)
+		if !ok {
+			stored = portal.bridge.DB.Nickname.New()
+			stored.Portal = portal.Key
+			stored.UserGMID = member.UserID
+		} else if stored.Nickname == member.Nickname && stored.SMS == sms {
+			continue
+		}
+		stored.Nickname = member.Nickname
+		stored.SMS = sms
+		stored.Upsert()
+	}
+	for _, left := range existing {
+		left.Delete()
+	}
+	portal.syncDisplaynames(false, func(*database.Nickname) bool {
+		return true
+	})
+}
+
+// syncDisplaynames sets the displaynames of the members for which filter
+// returns true, if they've changed or force is set. The caller must hold
+// nicknameLock.
+func (portal *Portal) syncDisplaynames(force bool, filter func(*database.Nickname) bool) {
+	nicknames := portal.bridge.DB.Nickname.GetAllByPortal(portal.Key)
+	counts := make(map[string]int, len(nicknames))
+	for _, nickname := range nicknames {
+		counts[normalizeNickname(nickname.Nickname)]++
+	}
+	for _, nickname := range nicknames {
+		if !filter(nickname) {
+			continue
+		}
+		name := portal.bridge.Config.Bridge.FormatDisplayname(config.DisplaynameTemplateArgs{
+			UserID:    nickname.UserGMID,
+			Nickname:  nickname.Nickname,
+			SMS:       nickname.SMS,
+			Collision: counts[normalizeNickname(nickname.Nickname)] > 1,
+		})
+		if !force && nickname.NameSet && nickname.Displayname == name {
+			continue
+		}
+		nickname.Displayname = name
+		nickname.NameSet = portal.bridge.GetPuppetByGMID(nickname.UserGMID).setRoomDisplayname(portal, name)
+		nickname.Upsert()
+	}
+}
+
+func (puppet *Puppet) setRoomDisplayname(portal *Portal, name string) bool {
+	_, err := puppet.DefaultIntent().SendStateEvent(portal.MXID, event.StateMember, puppet.MXID.String(), &event.MemberEventContent{
+		Membership:  event.MembershipJoin,
+		Displayname: name,
+		AvatarURL:   puppet.AvatarURL.CUString(),
+	})
+	if err != nil {
+		puppet.log.Warnfln("Failed to set displayname in %s: %v", portal.MXID, err)
+		return false
+	}
+	return true
+}
+
+// resyncNicknames sets the per-portal displaynames again after the global
+// profile changed, as the homeserver copies profile changes into every room.
+func (puppet *Puppet) resyncNicknames() {
+	for _, nickname := range puppet.bridge.DB.Nickname.GetAllByUser(puppet.GMID) {
+		portal := puppet.bridge.GetExistingPortalByGMID(nickname.Portal)
+		if portal == nil || len(portal.MXID) == 0 {
+			continue
+		}
+		portal.nicknameLock.Lock()
+		portal.syncDisplaynames(true, func(n *database.Nickname) bool {
+			return n.UserGMID == puppet.GMID
+		})
+		portal.nicknameLock.Unlock()
+	}
+}
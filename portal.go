@@ -22,7 +22,10 @@ import (
 	"errors"
 	"fmt"
 	"image"
-	"io/ioutil"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
 	"math"
 	"net/http"
 	"net/url"
@@ -37,8 +40,6 @@ import (
 	"maunium.net/go/mautrix/bridge/bridgeconfig"
 	"maunium.net/go/mautrix/crypto/attachment"
 
-	"github.com/gabriel-vasile/mimetype"
-
 	"github.com/beeper/groupme-lib"
 
 	"maunium.net/go/mautrix"
@@ -93,6 +94,16 @@ func (bridge *GMBridge) GetPortalByGMID(key database.PortalKey) *Portal {
 	return portal
 }
 
+func (bridge *GMBridge) GetExistingPortalByGMID(key database.PortalKey) *Portal {
+	bridge.portalsLock.Lock()
+	defer bridge.portalsLock.Unlock()
+	portal, ok := bridge.portalsByGMID[key]
+	if !ok {
+		return bridge.loadDBPortal(bridge.DB.Portal.GetByGMID(key), nil)
+	}
+	return portal
+}
+
 func (br *GMBridge) GetAllPortals() []*Portal {
 	return br.dbPortalsToPortals(br.DB.Portal.GetAll())
 }
@@ -155,8 +166,11 @@ func (bridge *GMBridge) NewManualPortal(key database.PortalKey) *Portal {
 		log:    bridge.Log.Sub(fmt.Sprintf("Portal/%s", key)),
 
 		recentlyHandled: make([]string, recentlyHandledLength),
+		lastTypingSent:  make(map[id.UserID]time.Time),
+		lastMarkedRead:  make(map[groupme.ID]groupme.ID),
 
-		messages: make(chan PortalMessage, bridge.Config.Bridge.PortalMessageBuffer),
+		messages:       make(chan PortalMessage, bridge.Config.Bridge.PortalMessageBuffer),
+		matrixMessages: make(chan PortalMatrixMessage, bridge.Config.Bridge.PortalMessageBuffer),
 	}
 	portal.Key = key
 	go portal.handleMessageLoop()
@@ -170,8 +184,11 @@ func (bridge *GMBridge) NewPortal(dbPortal *database.Portal) *Portal {
 		log:    bridge.Log.Sub(fmt.Sprintf("Portal/%s", dbPortal.Key)),
 
 		recentlyHandled: make([]string, recentlyHandledLength),
+		lastTypingSent:  make(map[id.UserID]time.Time),
+		lastMarkedRead:  make(map[groupme.ID]groupme.ID),
 
-		messages: make(chan PortalMessage, bridge.Config.Bridge.PortalMessageBuffer),
+		messages:       make(chan PortalMessage, bridge.Config.Bridge.PortalMessageBuffer),
+		matrixMessages: make(chan PortalMatrixMessage, bridge.Config.Bridge.PortalMessageBuffer),
 	}
 	go portal.handleMessageLoop()
 	return portal
@@ -184,6 +201,10 @@ type PortalMessage struct {
 	source    *User
 	data      *groupme.Message
 	timestamp uint64
+	// catchUp is set for messages that were fetched after a reconnect, which
+	// may be older than messages that already came in through the push
+	// connection.
+	catchUp bool
 }
 
 type PortalMatrixMessage struct {
@@ -205,6 +226,7 @@ type Portal struct {
 	recentlyHandledIndex uint8
 
 	encryptLock   sync.Mutex
+	backfillLock  sync.Mutex
 	backfilling   bool
 	lastMessageTs uint64
 
@@ -213,26 +235,56 @@ type Portal struct {
 	messages       chan PortalMessage
 	matrixMessages chan PortalMatrixMessage
 
+	typingLock     sync.Mutex
+	lastTypingSent map[id.UserID]time.Time
+
+	nicknameLock sync.Mutex
+
+	readReceiptLock sync.Mutex
+	lastReadReceipt groupme.ID
+	lastMarkedRead  map[groupme.ID]groupme.ID
+
 	hasRelaybot *bool
 }
 
 const MaxMessageAgeToCreatePortal = 5 * 60 // 5 minutes
 
 func (portal *Portal) handleMessageLoop() {
-	for msg := range portal.messages {
-		if len(portal.MXID) == 0 {
-			if msg.timestamp+MaxMessageAgeToCreatePortal < uint64(time.Now().Unix()) {
-				portal.log.Debugln("Not creating portal room for incoming message: message is too old")
-				continue
-			}
-			portal.log.Debugln("Creating Matrix room from incoming message")
-			err := portal.CreateMatrixRoom(msg.source)
-			if err != nil {
-				portal.log.Errorln("Failed to create portal room:", err)
-				continue
-			}
+	for {
+		select {
+		case msg := <-portal.messages:
+			portal.handleMessageLoopItem(msg)
+		case msg := <-portal.matrixMessages:
+			portal.handleMatrixMessageLoopItem(msg)
 		}
-		portal.handleMessage(msg)
+	}
+}
+
+func (portal *Portal) handleMessageLoopItem(msg PortalMessage) {
+	if len(portal.MXID) == 0 {
+		if msg.timestamp+MaxMessageAgeToCreatePortal < uint64(time.Now().Unix()) {
+			portal.log.Debugln("Not creating portal room for incoming message: message is too old")
+			return
+		}
+		portal.log.Debugln("Creating Matrix room from incoming message")
+		err := portal.CreateMatrixRoom(msg.source)
+		if err != nil {
+			portal.log.Errorln("Failed to create portal room:", err)
+			return
+		}
+	}
+	portal.handleMessage(msg)
+	portal.updateLastMessageID(msg.data.ID)
+}
+
+func (portal *Portal) handleMatrixMessageLoopItem(msg PortalMatrixMessage) {
+	switch msg.evt.Type {
+	case event.EventMessage, event.EventSticker:
+		portal.HandleMatrixMessage(msg.user, msg.evt)
+	case event.EventRedaction:
+		portal.HandleMatrixRedaction(msg.user, msg.evt)
+	default:
+		portal.log.Warnfln("Unsupported event type %+v in portal message channel", msg.evt.Type)
 	}
 }
 
@@ -241,7 +293,7 @@ func (portal *Portal) handleMessage(msg PortalMessage) {
 		portal.log.Warnln("handleMessage called even though portal.MXID is empty")
 		return
 	}
-	portal.HandleTextMessage(msg.source, msg.data)
+	portal.HandleTextMessage(msg.source, msg.data, msg.catchUp)
 	// portal.handleReaction(msg.data.ID.String(), msg.data.FavoritedBy)
 }
 
@@ -280,7 +332,10 @@ func (portal *Portal) markHandled(source *User, message *groupme.Message, mxid i
 	} else {
 		msg.Sender = message.SenderID
 	}
-	// msg.Insert()
+	if len(mxid) > 0 {
+		msg.Sent = true
+		msg.Insert()
+	}
 
 	portal.recentlyHandledLock.Lock()
 	portal.recentlyHandled[0] = "" //FIFO queue being implemented here //TODO: is this efficent
@@ -292,7 +347,7 @@ func (portal *Portal) markHandled(source *User, message *groupme.Message, mxid i
 func (portal *Portal) getMessageIntent(user *User, info *groupme.Message) *appservice.IntentAPI {
 	if portal.IsPrivateChat() {
 		if info.UserID == user.GetGMID() { //from me
-			return portal.bridge.GetPuppetByGMID(user.GMID).DefaultIntent()
+			return portal.bridge.GetPuppetByGMID(user.GMID).IntentFor(portal)
 		}
 		return portal.MainIntent()
 	} else if len(info.UserID.String()) == 0 {
@@ -307,9 +362,9 @@ func (portal *Portal) getReactionIntent(jid groupme.ID) *appservice.IntentAPI {
 	return portal.bridge.GetPuppetByGMID(jid).IntentFor(portal)
 }
 
-func (portal *Portal) startHandling(source *User, info *groupme.Message) *appservice.IntentAPI {
+func (portal *Portal) startHandling(source *User, info *groupme.Message, catchUp bool) *appservice.IntentAPI {
 	// TODO these should all be trace logs
-	if portal.lastMessageTs > uint64(info.CreatedAt.ToTime().Unix()+1) {
+	if !catchUp && portal.lastMessageTs > uint64(info.CreatedAt.ToTime().Unix()+1) {
 		portal.log.Debugfln("Not handling %s: message is older (%d) than last bridge message (%d)", info.ID, info.CreatedAt, portal.lastMessageTs)
 	} else if portal.isRecentlyHandled(info.ID) {
 		portal.log.Debugfln("Not handling %s: message was recently handled", info.ID)
@@ -318,7 +373,9 @@ func (portal *Portal) startHandling(source *User, info *groupme.Message) *appser
 	} else if info.System {
 		portal.log.Debugfln("Not handling %s: message is from system: %s", info.ID, info.Text)
 	} else {
-		portal.lastMessageTs = uint64(info.CreatedAt.ToTime().Unix())
+		if ts := uint64(info.CreatedAt.ToTime().Unix()); ts > portal.lastMessageTs {
+			portal.lastMessageTs = ts
+		}
 		intent := portal.getMessageIntent(source, info)
 		if intent != nil {
 			portal.log.Debugfln("Starting handling of %s (ts: %d)", info.ID, info.CreatedAt)
@@ -365,8 +422,9 @@ func (portal *Portal) SyncParticipants(metadata *groupme.Group) {
 		if user != nil {
 			changed = levels.EnsureUserLevel(user.MXID, expectedLevel) || changed
 		}
-		puppet.Sync(nil, participant, false, false)
+		portal.syncMember(nil, puppet, *participant)
 	}
+	portal.syncNicknames(metadata.Members)
 	if changed {
 		_, err = portal.MainIntent().SetPowerLevels(portal.MXID, levels)
 		if err != nil {
@@ -395,8 +453,40 @@ func (portal *Portal) SyncParticipants(metadata *groupme.Group) {
 	}
 }
 
-func (user *User) updateAvatar(gmdi groupme.ID, avatarID *string, avatarURL *id.ContentURI, avatarSet *bool, log log.Logger, intent *appservice.IntentAPI) bool {
-	return false
+// syncMember syncs the profile of a chat member. Group nicknames are only
+// used as the global name until the real one is known from the user's
+// relations.
+func (portal *Portal) syncMember(source *User, puppet *Puppet, member groupme.Member) {
+	profile := groupme.Member{
+		UserID:   member.UserID,
+		ImageURL: member.ImageURL,
+	}
+	if portal.IsPrivateChat() || len(puppet.Displayname) == 0 {
+		profile.Nickname = member.Nickname
+	}
+	puppet.Sync(source, &profile, false, false)
+}
+
+// updateAvatar uploads the GroupMe avatar at the given URL if it's different
+// from the current one. The avatar still has to be set on Matrix by the
+// caller, which should set avatarSet once that's done.
+func (bridge *GMBridge) updateAvatar(avatar string, avatarID *string, avatarURL *id.ContentURI, avatarSet *bool, log log.Logger, intent *appservice.IntentAPI) bool {
+	if *avatarID == avatar && *avatarSet {
+		return false
+	}
+	if len(avatar) == 0 {
+		*avatarURL = id.ContentURI{}
+	} else {
+		url, err := bridge.uploadAvatar(intent, avatar, ".avatar")
+		if err != nil {
+			log.Warnln("Failed to bridge avatar:", err)
+			return false
+		}
+		*avatarURL = url
+	}
+	*avatarID = avatar
+	*avatarSet = false
+	return true
 }
 
 func (portal *Portal) UpdateAvatar(user *User, avatar string, updateInfo bool) bool {
@@ -426,33 +516,15 @@ func (portal *Portal) UpdateAvatar(user *User, avatar string, updateInfo bool) b
 		return false
 	}
 
-	//TODO check its actually groupme?
-	response, err := http.Get(avatar + ".large")
+	avatarURL, err := portal.bridge.uploadAvatar(portal.MainIntent(), avatar, ".large")
 	if err != nil {
-		portal.log.Warnln("Failed to download avatar:", err)
+		portal.log.Warnln("Failed to bridge avatar:", err)
 		return false
 	}
-	defer response.Body.Close()
 
-	image, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		portal.log.Warnln("Failed to read downloaded avatar:", err)
-		return false
-	}
-
-	mime := response.Header.Get("Content-Type")
-	if len(mime) == 0 {
-		mime = http.DetectContentType(image)
-	}
-	resp, err := portal.MainIntent().UploadBytes(image, mime)
-	if err != nil {
-		portal.log.Warnln("Failed to upload avatar:", err)
-		return false
-	}
-
-	portal.AvatarURL = resp.ContentURI
+	portal.AvatarURL = avatarURL
 	if len(portal.MXID) > 0 {
-		_, err = portal.MainIntent().SetRoomAvatar(portal.MXID, resp.ContentURI)
+		_, err = portal.MainIntent().SetRoomAvatar(portal.MXID, avatarURL)
 		if err != nil {
 			portal.log.Warnln("Failed to set room topic:", err)
 			return false
@@ -554,11 +626,14 @@ func (portal *Portal) ensureUserInvited(user *User) bool {
 func (portal *Portal) Sync(user *User, group *groupme.Group) {
 	portal.log.Infoln("Syncing portal for", user.MXID)
 
-	sub := user.Conn.SubscribeToGroup
-	if portal.IsPrivateChat() {
-		sub = user.Conn.SubscribeToDM
+	var err error
+	if conn, _ := user.getConnection(); conn == nil {
+		// The push connection is closed, so there is nothing to subscribe to
+	} else if portal.IsPrivateChat() {
+		err = conn.SubscribeToDM(context.TODO(), groupmeext.DirectMessageChatID(user.GMID, portal.Key.GMID), user.Token)
+	} else {
+		err = conn.SubscribeToGroup(context.TODO(), portal.Key.GMID, user.Token)
 	}
-	err := sub(context.TODO(), groupme.ID(portal.Key.Receiver), user.Token)
 	if err != nil {
 		portal.log.Errorln("Subscribing failed, live metadata updates won't work", err)
 	}
@@ -799,6 +874,11 @@ func (portal *Portal) CreateMatrixRoom(user *User) error {
 		}
 	}
 
+	var roomVersion string
+	if portal.bridge.Config.Bridge.HistorySync.Backfill {
+		roomVersion = batchSendRoomVersion
+	}
+
 	resp, err := intent.CreateRoom(&mautrix.ReqCreateRoom{
 		Visibility:   "private",
 		Name:         portal.Name,
@@ -807,6 +887,7 @@ func (portal *Portal) CreateMatrixRoom(user *User) error {
 		Preset:       "private_chat",
 		IsDirect:     portal.IsPrivateChat(),
 		InitialState: initialState,
+		RoomVersion:  roomVersion,
 	})
 	if err != nil {
 		return err
@@ -847,6 +928,9 @@ func (portal *Portal) CreateMatrixRoom(user *User) error {
 
 		user.UpdateDirectChats(map[id.UserID][]id.RoomID{puppet.MXID: {portal.MXID}})
 	}
+	if portal.bridge.Config.Bridge.HistorySync.Backfill {
+		portal.backfillNewPortal(user)
+	}
 	return nil
 }
 
@@ -948,33 +1032,10 @@ func (portal *Portal) sendMessage(intent *appservice.IntentAPI, eventType event.
 	}
 }
 
-func (portal *Portal) handleAttachment(intent *appservice.IntentAPI, attachment *groupme.Attachment, source *User, message *groupme.Message) (msg *event.MessageEventContent, sendText bool, err error) {
+func (portal *Portal) handleAttachment(ctx context.Context, intent *appservice.IntentAPI, attachment *groupme.Attachment, source *User, message *groupme.Message) (msg *event.MessageEventContent, sendText bool, err error) {
 	sendText = true
 	switch attachment.Type {
 	case "image":
-		imgData, mime, err := groupmeext.DownloadImage(attachment.URL)
-		if err != nil {
-			return nil, true, fmt.Errorf("failed to load media info: %w", err)
-		}
-
-		var width, height int
-		if strings.HasPrefix(mime, "image/") {
-			cfg, _, _ := image.DecodeConfig(bytes.NewReader(*imgData))
-			width, height = cfg.Width, cfg.Height
-		}
-		data, uploadMimeType, file := portal.encryptFile(*imgData, mime)
-
-		uploaded, err := intent.UploadBytes(data, uploadMimeType)
-		if err != nil {
-			if errors.Is(err, mautrix.MTooLarge) {
-				err = errors.New("homeserver rejected too large file")
-			} else if httpErr := err.(mautrix.HTTPError); httpErr.IsStatus(413) {
-				err = errors.New("proxy rejected too large file")
-			} else {
-				err = fmt.Errorf("failed to upload media: %w", err)
-			}
-			return nil, true, err
-		}
 		attachmentUrl, _ := url.Parse(attachment.URL)
 		urlParts := strings.Split(attachmentUrl.Path, ".")
 		var fname1, fname2 string
@@ -986,101 +1047,52 @@ func (portal *Portal) handleAttachment(intent *appservice.IntentAPI, attachment
 		fname := fmt.Sprintf("%s.%s", fname1, fname2)
 
 		content := &event.MessageEventContent{
-			Body: fname,
-			File: file,
-			Info: &event.FileInfo{
-				Size:     len(data),
-				MimeType: mime,
-				Width:    width,
-				Height:   height,
-				//Duration: int(msg.length),
-			},
+			MsgType: event.MsgImage,
+			Body:    fname,
 		}
-		if content.File != nil {
-			content.File.URL = uploaded.ContentURI.CUString()
-		} else {
-			content.URL = uploaded.ContentURI.CUString()
+		err = portal.bridgeMedia(ctx, intent, attachment.URL, func() (*groupmeext.Media, error) {
+			return groupmeext.DownloadImage(ctx, attachment.URL)
+		}, content)
+		if err != nil {
+			return nil, true, err
 		}
-		//TODO thumbnail since groupme supports it anyway
-		content.MsgType = event.MsgImage
+		portal.uploadThumbnail(ctx, intent, attachment.URL+".preview", content)
 
 		return content, true, nil
 	case "video":
-		vidContents, mime := groupmeext.DownloadVideo(attachment.VideoPreviewURL, attachment.URL, source.Token)
-		if mime == "" {
-			mime = mimetype.Detect(vidContents).String()
+		text := strings.Split(attachment.URL, "/")
+		content := &event.MessageEventContent{
+			MsgType: event.MsgVideo,
+			Body:    text[len(text)-1],
 		}
-
-		data, uploadMimeType, file := portal.encryptFile(vidContents, mime)
-		uploaded, err := intent.UploadBytes(data, uploadMimeType)
+		err = portal.bridgeMedia(ctx, intent, attachment.URL, func() (*groupmeext.Media, error) {
+			return groupmeext.DownloadVideo(ctx, attachment.URL, source.Token)
+		}, content)
 		if err != nil {
-			if errors.Is(err, mautrix.MTooLarge) {
-				err = errors.New("homeserver rejected too large file")
-			} else if httpErr := err.(mautrix.HTTPError); httpErr.IsStatus(413) {
-				err = errors.New("proxy rejected too large file")
-			} else {
-				err = fmt.Errorf("failed to upload media: %w", err)
-			}
 			return nil, true, err
 		}
-
-		text := strings.Split(attachment.URL, "/")
-		content := &event.MessageEventContent{
-			Body: text[len(text)-1],
-			File: file,
-			Info: &event.FileInfo{
-				Size:     len(data),
-				MimeType: mime,
-				//Width:    width,
-				//Height:   height,
-				//Duration: int(msg.length),
-			},
-		}
-		if content.File != nil {
-			content.File.URL = uploaded.ContentURI.CUString()
-		} else {
-			content.URL = uploaded.ContentURI.CUString()
+		if len(attachment.VideoPreviewURL) > 0 {
+			portal.uploadThumbnail(ctx, intent, attachment.VideoPreviewURL, content)
 		}
-		content.MsgType = event.MsgVideo
 
 		message.Text = strings.Replace(message.Text, attachment.URL, "", 1)
 		return content, true, nil
 	case "file":
-		fileData, fname, fmime := groupmeext.DownloadFile(portal.Key.GMID, attachment.FileID, source.Token)
-		if fmime == "" {
-			fmime = mimetype.Detect(fileData).String()
-		}
-		data, uploadMimeType, file := portal.encryptFile(fileData, fmime)
-
-		uploaded, err := intent.UploadBytes(data, uploadMimeType)
-		if err != nil {
-			if errors.Is(err, mautrix.MTooLarge) {
-				err = errors.New("homeserver rejected too large file")
-			} else if httpErr := err.(mautrix.HTTPError); httpErr.IsStatus(413) {
-				err = errors.New("proxy rejected too large file")
-			} else {
-				err = fmt.Errorf("failed to upload media: %w", err)
+		content := &event.MessageEventContent{}
+		fileURL := groupmeext.FileURL(portal.Key.GMID, attachment.FileID)
+		err = portal.bridgeMedia(ctx, intent, fileURL, func() (*groupmeext.Media, error) {
+			media, err := groupmeext.DownloadFile(ctx, portal.Key.GMID, attachment.FileID, source.Token)
+			if err != nil {
+				return nil, err
 			}
+			content.Body = media.FileName
+			return media, nil
+		}, content)
+		if err != nil {
 			return nil, true, err
 		}
-
-		content := &event.MessageEventContent{
-			Body: fname,
-			File: file,
-			Info: &event.FileInfo{
-				Size:     len(data),
-				MimeType: fmime,
-				//Width:    width,
-				//Height:   height,
-				//Duration: int(msg.length),
-			},
-		}
-		if content.File != nil {
-			content.File.URL = uploaded.ContentURI.CUString()
-		} else {
-			content.URL = uploaded.ContentURI.CUString()
-		}
-		//TODO thumbnail since groupme supports it anyway
+		// GroupMe doesn't generate previews for files, so there's no thumbnail here
+		fmime := content.Info.MimeType
 		if strings.HasPrefix(fmime, "image") {
 			content.MsgType = event.MsgImage
 		} else if strings.HasPrefix(fmime, "video") {
@@ -1127,52 +1139,57 @@ func (portal *Portal) handleAttachment(intent *appservice.IntentAPI, attachment
 	// return nil, true, errors.New("Unknown type")
 }
 
-func (portal *Portal) HandleTextMessage(source *User, message *groupme.Message) {
-	intent := portal.startHandling(source, message)
-	if intent == nil {
-		return
-	}
-
+// convertMessage converts the attachments and text of a GroupMe message into
+// Matrix message contents. Attachments that can't be bridged are replaced with
+// a notice saying why.
+func (portal *Portal) convertMessage(intent *appservice.IntentAPI, source *User, message *groupme.Message) []*event.MessageEventContent {
+	var contents []*event.MessageEventContent
 	sendText := true
-	var sentID id.EventID
 	for _, a := range message.Attachments {
-		msg, text, err := portal.handleAttachment(intent, a, source, message)
+		ctx, cancel := context.WithTimeout(context.Background(), mediaTimeout)
+		content, text, err := portal.handleAttachment(ctx, intent, a, source, message)
+		cancel()
 
 		if err != nil {
-			portal.log.Errorfln("Failed to handle message %s: %v", "TODOID", err)
-			portal.sendMediaBridgeFailure(source, intent, *message, err)
+			portal.log.Errorfln("Failed to bridge %s attachment of %s: %v", a.Type, message.ID, err)
+			contents = append(contents, &event.MessageEventContent{
+				MsgType: event.MsgNotice,
+				Body:    mediaFailureNotice(err),
+			})
 			continue
 		}
-		if msg == nil {
+		if content == nil {
 			continue
 		}
-		resp, err := portal.sendMessage(intent, event.EventMessage, msg, nil, message.CreatedAt.ToTime().Unix())
-		if err != nil {
-			portal.log.Errorfln("Failed to handle message %s: %v", "TODOID", err)
-			portal.sendMediaBridgeFailure(source, intent, *message, err)
-			continue
-		}
-		sentID = resp.EventID
-
+		contents = append(contents, content)
 		sendText = sendText && text
 	}
 
 	//	portal.SetReply(content, message.ContextInfo)
 	//TODO: mentions
-	content := &event.MessageEventContent{
-		Body:    message.Text,
-		MsgType: event.MsgText,
+	if sendText {
+		contents = append(contents, &event.MessageEventContent{
+			Body:    message.Text,
+			MsgType: event.MsgText,
+		})
 	}
+	return contents
+}
 
-	_, _ = intent.UserTyping(portal.MXID, false, 0)
-	if sendText {
-		resp, err := portal.sendMessage(intent, event.EventMessage, content, nil, message.CreatedAt.ToTime().Unix())
+func (portal *Portal) HandleTextMessage(source *User, message *groupme.Message, catchUp bool) {
+	intent := portal.startHandling(source, message, catchUp)
+	if intent == nil {
+		return
+	}
+
+	var sentID id.EventID
+	for _, content := range portal.convertMessage(intent, source, message) {
+		resp, err := portal.sendMessage(intent, event.EventMessage, content, nil, message.CreatedAt.ToTime().UnixMilli())
 		if err != nil {
 			portal.log.Errorfln("Failed to handle message %s: %v", message.ID, err)
-			return
+			continue
 		}
 		sentID = resp.EventID
-
 	}
 	portal.finishHandling(source, message, sentID)
 }
@@ -1260,16 +1277,63 @@ func (portal *Portal) HandleTextMessage(source *User, message *groupme.Message)
 // 	return
 // }
 
-func (portal *Portal) sendMediaBridgeFailure(source *User, intent *appservice.IntentAPI, message groupme.Message, bridgeErr error) {
-	portal.log.Errorfln("Failed to bridge media for %s: %v", message.UserID.String(), bridgeErr)
-	resp, err := portal.sendMessage(intent, event.EventMessage, &event.MessageEventContent{
-		MsgType: event.MsgNotice,
-		Body:    "Failed to bridge media",
-	}, nil, int64(message.CreatedAt.ToTime().Unix()*1000))
+// uploadThumbnail uploads a preview image generated by GroupMe and sets it as
+// the thumbnail of the given media message. Failures are only logged, since
+// the message is still usable without a thumbnail.
+func (portal *Portal) uploadThumbnail(ctx context.Context, intent *appservice.IntentAPI, previewURL string, content *event.MessageEventContent) {
+	if !portal.Encrypted {
+		if cached := portal.bridge.DB.Media.GetByURL(previewURL); cached != nil {
+			content.Info.ThumbnailURL = cached.MXC.CUString()
+			content.Info.ThumbnailInfo = &event.FileInfo{
+				Size:     int(cached.Size),
+				MimeType: cached.MimeType,
+				Width:    cached.Width,
+				Height:   cached.Height,
+			}
+			return
+		}
+	}
+	media, err := groupmeext.DownloadImage(ctx, previewURL)
 	if err != nil {
-		portal.log.Errorfln("Failed to send media download error message for %s: %v", message.UserID.String(), err)
+		portal.log.Warnfln("Failed to download thumbnail %s: %v", previewURL, err)
+		return
+	}
+	// Previews are small enough to handle in memory, but they still come from
+	// GroupMe, so don't trust them to actually be small
+	var reader io.Reader = media
+	if maxSize := portal.bridge.Config.Bridge.MaxMediaBytes(); maxSize >= 0 {
+		reader = &limitedReader{r: media, remaining: maxSize, limit: maxSize}
+	}
+	thumbnail, err := io.ReadAll(reader)
+	_ = media.Close()
+	if err != nil {
+		portal.log.Warnfln("Failed to download thumbnail %s: %v", previewURL, err)
+		return
+	}
+	cfg, _, _ := image.DecodeConfig(bytes.NewReader(thumbnail))
+	info := &event.FileInfo{
+		Size:     len(thumbnail),
+		MimeType: media.MimeType,
+		Width:    cfg.Width,
+		Height:   cfg.Height,
+	}
+	data, uploadMimeType, file := portal.encryptFile(thumbnail, media.MimeType)
+	uploaded, err := uploadWithContext(ctx, intent, mautrix.ReqUploadMedia{
+		ContentBytes: data,
+		ContentType:  uploadMimeType,
+	})
+	if err != nil {
+		portal.log.Warnfln("Failed to upload thumbnail %s: %v", previewURL, err)
+		return
+	}
+
+	content.Info.ThumbnailInfo = info
+	if file != nil {
+		file.URL = uploaded.ContentURI.CUString()
+		content.Info.ThumbnailFile = file
 	} else {
-		portal.finishHandling(source, &message, resp.EventID)
+		content.Info.ThumbnailURL = uploaded.ContentURI.CUString()
+		portal.bridge.cacheMedia(previewURL, uploaded.ContentURI, "", info)
 	}
 }
 
@@ -1282,7 +1346,8 @@ func (portal *Portal) encryptFile(data []byte, mimeType string) ([]byte, string,
 		EncryptedFile: *attachment.NewEncryptedFile(),
 		URL:           "",
 	}
-	return file.Encrypt(data), "application/octet-stream", file
+	file.EncryptInPlace(data)
+	return data, "application/octet-stream", file
 }
 
 func (portal *Portal) tryKickUser(userID id.UserID, intent *appservice.IntentAPI) error {
@@ -1335,11 +1400,11 @@ func (portal *Portal) convertMatrixMessage(sender *User, evt *event.Event) ([]*g
 	//		Status:           &status,
 	//	}
 	//
-	info := groupme.Message{
-		GroupID:        groupme.ID(portal.Key.String()),
-		ConversationID: groupme.ID(portal.Key.String()),
-		ChatID:         groupme.ID(portal.Key.String()),
-		RecipientID:    groupme.ID(portal.Key.GMID),
+	var info groupme.Message
+	if portal.IsPrivateChat() {
+		info.RecipientID = portal.Key.GMID
+	} else {
+		info.GroupID = portal.Key.GMID
 	}
 	replyToID := content.GetReplyTo()
 	if len(replyToID) > 0 {
@@ -1369,6 +1434,27 @@ func (portal *Portal) convertMatrixMessage(sender *User, evt *event.Event) ([]*g
 			text = "/me " + text
 		}
 		info.Text = text
+	case event.MsgImage:
+		// Images that were bridged from GroupMe can be sent again without
+		// uploading them to the GroupMe image service
+		mxc := content.URL
+		if content.File != nil {
+			mxc = content.File.URL
+		}
+		parsedMXC, err := mxc.Parse()
+		if err != nil {
+			portal.log.Debugfln("Failed to handle event %s: invalid content URI %s", evt.ID, mxc)
+			return nil, sender
+		}
+		media := portal.bridge.DB.Media.GetByMXC(parsedMXC)
+		if media == nil || !groupmeext.IsImageURL(media.URL) {
+			portal.log.Debugfln("Unhandled Matrix event %s: image wasn't bridged from GroupMe", evt.ID)
+			return nil, sender
+		}
+		info.Attachments = append(info.Attachments, &groupme.Attachment{
+			Type: "image",
+			URL:  media.URL,
+		})
 
 	default:
 		portal.log.Debugln("Unhandled Matrix event %s: unknown msgtype %s", evt.ID, content.MsgType)
@@ -1427,6 +1513,7 @@ func (portal *Portal) sendRaw(sender *User, evt *event.Event, info *groupme.Mess
 		if retries > 0 {
 			return portal.sendRaw(sender, evt, info, retries-1)
 		}
+		return nil, err
 	}
 	return m, nil
 }
@@ -1535,3 +1622,107 @@ func (portal *Portal) HandleMatrixKick(sender *User, evt *event.Event) {
 
 func (portal *Portal) HandleMatrixInvite(sender *User, evt *event.Event) {
 }
+
+// GroupMe clients show a typing indicator for a few seconds after each
+// notification, so there's no point in sending them more often than this.
+const typingNotificationInterval = 5 * time.Second
+
+func (portal *Portal) HandleMatrixTyping(userIDs []id.UserID) {
+	portal.typingLock.Lock()
+	defer portal.typingLock.Unlock()
+	now := time.Now()
+	for _, userID := range userIDs {
+		if now.Sub(portal.lastTypingSent[userID]) < typingNotificationInterval {
+			continue
+		}
+		user := portal.bridge.GetUserByMXIDIfExists(userID)
+		if user == nil || !user.HasSession() || !user.IsConnected() {
+			continue
+		} else if portal.IsPrivateChat() && portal.Key.Receiver != user.GMID {
+			continue
+		}
+		portal.lastTypingSent[userID] = now
+		go portal.sendTyping(user)
+	}
+}
+
+func (portal *Portal) sendTyping(user *User) {
+	chatID := portal.Key.GMID
+	if portal.IsPrivateChat() {
+		chatID = groupmeext.DirectMessageChatID(user.GMID, portal.Key.GMID)
+	}
+	_, faye := user.getConnection()
+	if faye == nil {
+		return
+	}
+	err := faye.SendTyping(user.GMID, chatID, portal.IsPrivateChat())
+	if err != nil {
+		portal.log.Warnfln("Failed to send typing notification as %s: %v", user.MXID, err)
+	}
+}
+
+// HandleGroupMeReadReceipt marks the message the other user of a private chat
+// has read as read by their puppet.
+func (portal *Portal) HandleGroupMeReadReceipt(receipt groupmeext.ReadReceipt) {
+	if len(portal.MXID) == 0 || !portal.IsPrivateChat() || receipt.UserID != portal.Key.GMID {
+		return
+	}
+	portal.readReceiptLock.Lock()
+	defer portal.readReceiptLock.Unlock()
+	if portal.lastReadReceipt == receipt.MessageID {
+		return
+	}
+	puppet := portal.bridge.GetPuppetByGMID(receipt.UserID)
+	if puppet == nil || !puppet.EnableReceipts {
+		return
+	}
+	message := portal.bridge.DB.Message.GetByGMID(portal.Key, receipt.MessageID)
+	if message == nil {
+		message = portal.bridge.DB.Message.GetLastInChatBefore(portal.Key, receipt.ReadAt.ToTime())
+	}
+	if message == nil {
+		portal.log.Debugfln("Ignoring read receipt for unknown message %s", receipt.MessageID)
+		return
+	}
+	err := puppet.IntentFor(portal).MarkRead(portal.MXID, message.MXID)
+	if err != nil {
+		portal.log.Warnfln("Failed to mark %s as read by %s: %v", message.MXID, puppet.MXID, err)
+		return
+	}
+	portal.lastReadReceipt = receipt.MessageID
+}
+
+func (portal *Portal) HandleMatrixReadReceipt(brUser bridge.User, eventID id.EventID, receipt event.ReadReceipt) {
+	user := brUser.(*User)
+	if user.Client == nil || len(user.GMID) == 0 || !user.ReceiptsEnabled() {
+		return
+	} else if portal.IsPrivateChat() && portal.Key.Receiver != user.GMID {
+		return
+	}
+
+	message := portal.bridge.DB.Message.GetByMXID(eventID)
+	if message == nil || message.Chat != portal.Key {
+		message = portal.bridge.DB.Message.GetLastInChatBefore(portal.Key, receipt.Timestamp)
+	}
+	if message == nil {
+		portal.log.Debugfln("Not marking %s as read for %s: no GroupMe message found", eventID, user.MXID)
+		return
+	}
+
+	portal.readReceiptLock.Lock()
+	defer portal.readReceiptLock.Unlock()
+	if portal.lastMarkedRead[user.GMID] == message.GMID {
+		return
+	}
+	chatID := portal.Key.GMID
+	if portal.IsPrivateChat() {
+		chatID = groupmeext.DirectMessageChatID(user.GMID, portal.Key.GMID)
+	}
+	err := user.Client.MarkRead(context.TODO(), chatID, message.GMID)
+	if err != nil {
+		portal.log.Warnfln("Failed to mark %s as read for %s: %v", message.GMID, user.MXID, err)
+		return
+	}
+	portal.log.Debugfln("Marked %s (%s) as read for %s", message.GMID, eventID, user.MXID)
+	portal.lastMarkedRead[user.GMID] = message.GMID
+}
@@ -18,24 +18,37 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	log "maunium.net/go/maulogger/v2"
 
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
 	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/groupme-lib"
 )
 
 type ProvisioningAPI struct {
 	bridge *GMBridge
 	log    log.Logger
+
+	passwordLoginsLock sync.Mutex
+	passwordLogins     map[id.UserID]*PasswordLogin
 }
 
 func (prov *ProvisioningAPI) Init() {
 	prov.log = prov.bridge.Log.Sub("Provisioning")
+	prov.passwordLogins = make(map[id.UserID]*PasswordLogin)
 	prov.log.Debugln("Enabling provisioning API at", prov.bridge.Config.Bridge.Provisioning.Prefix)
 	r := prov.bridge.AS.Router.PathPrefix(prov.bridge.Config.Bridge.Provisioning.Prefix).Subrouter()
 	r.Use(prov.AuthMiddleware)
+	r.HandleFunc("/v1/login", prov.Login).Methods(http.MethodPost)
+	r.HandleFunc("/v1/login/password", prov.LoginPassword).Methods(http.MethodPost)
+	r.HandleFunc("/v1/login/verify", prov.LoginVerify).Methods(http.MethodPost)
 }
 
 func (prov *ProvisioningAPI) AuthMiddleware(h http.Handler) http.Handler {
@@ -60,8 +73,29 @@ func (prov *ProvisioningAPI) AuthMiddleware(h http.Handler) http.Handler {
 			})
 			return
 		}
-		userID := r.URL.Query().Get("user_id")
-		user := prov.bridge.GetUserByMXID(id.UserID(userID))
+		userID := id.UserID(r.URL.Query().Get("user_id"))
+		if _, _, err := userID.Parse(); err != nil {
+			jsonResponse(w, http.StatusBadRequest, map[string]interface{}{
+				"error":   "Missing or invalid user_id",
+				"errcode": "M_INVALID_PARAM",
+			})
+			return
+		} else if prov.bridge.Config.Bridge.Permissions.Get(userID) < bridgeconfig.PermissionLevelUser {
+			jsonResponse(w, http.StatusForbidden, map[string]interface{}{
+				"error":   "You don't have permission to use the bridge",
+				"errcode": "M_FORBIDDEN",
+			})
+			return
+		}
+		// Ghosts and the bridge bot don't have users
+		user := prov.bridge.GetUserByMXID(userID)
+		if user == nil {
+			jsonResponse(w, http.StatusBadRequest, map[string]interface{}{
+				"error":   "Invalid user_id",
+				"errcode": "M_INVALID_PARAM",
+			})
+			return
+		}
 		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "user", user)))
 	})
 }
@@ -77,6 +111,219 @@ type Response struct {
 	Status  string `json:"status"`
 }
 
+type LoginRequest struct {
+	AccessToken string `json:"access_token"`
+}
+
+type LoginResponse struct {
+	Success bool       `json:"success"`
+	GMID    groupme.ID `json:"gmid"`
+	Name    string     `json:"name"`
+	Phone   string     `json:"phone,omitempty"`
+	Email   string     `json:"email,omitempty"`
+}
+
+type PasswordLoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type VerifyLoginRequest struct {
+	Code string `json:"code"`
+}
+
+type ChallengeResponse struct {
+	Success bool   `json:"success"`
+	Status  string `json:"status"`
+	Method  string `json:"method"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+func (prov *ProvisioningAPI) checkNotLoggedIn(w http.ResponseWriter, user *User) bool {
+	if user.Client != nil {
+		jsonResponse(w, http.StatusConflict, Error{
+			Error:   "You're already logged in",
+			ErrCode: "already logged in",
+		})
+		return false
+	}
+	return true
+}
+
+func (prov *ProvisioningAPI) Login(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	if !prov.checkNotLoggedIn(w, user) {
+		return
+	}
+
+	var req LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.AccessToken) == 0 {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Missing access token",
+			ErrCode: "bad request",
+		})
+		return
+	}
+	prov.finishLogin(w, user, req.AccessToken)
+}
+
+// passwordLoginTimeout is how long a password login waits for the answer to
+// its challenge before it has to be started again.
+const passwordLoginTimeout = 10 * time.Minute
+
+// LoginPassword starts a login with a username and password. If GroupMe asks
+// for a PIN or verification code, the login continues with LoginVerify.
+func (prov *ProvisioningAPI) LoginPassword(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	if !prov.checkNotLoggedIn(w, user) {
+		return
+	}
+
+	var req PasswordLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Username) == 0 || len(req.Password) == 0 {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Missing username or password",
+			ErrCode: "bad request",
+		})
+		return
+	}
+
+	// A new login replaces any earlier one that's still waiting for a code
+	prov.passwordLoginsLock.Lock()
+	delete(prov.passwordLogins, user.MXID)
+	prov.passwordLoginsLock.Unlock()
+
+	login := user.NewPasswordLogin()
+	login.Username = req.Username
+	result, err := login.Client.Login(r.Context(), req.Username, req.Password)
+	if isUnauthorized(err) {
+		jsonResponse(w, http.StatusUnauthorized, Error{
+			Error:   "Incorrect username or password",
+			ErrCode: "invalid credentials",
+		})
+		return
+	} else if err != nil {
+		prov.log.Warnfln("Failed to log in %s with password: %v", user.MXID, err)
+		jsonResponse(w, http.StatusBadGateway, Error{
+			Error:   "Failed to log in to GroupMe",
+			ErrCode: "groupme error",
+		})
+		return
+	} else if result.Challenge == nil {
+		prov.finishLogin(w, user, result.AccessToken)
+		return
+	}
+
+	login.Challenge = result.Challenge
+	prov.passwordLoginsLock.Lock()
+	// Drop logins that were abandoned halfway, so they don't pile up
+	for userID, pending := range prov.passwordLogins {
+		if time.Since(pending.Started) > passwordLoginTimeout {
+			delete(prov.passwordLogins, userID)
+		}
+	}
+	prov.passwordLogins[user.MXID] = login
+	prov.passwordLoginsLock.Unlock()
+	jsonResponse(w, http.StatusAccepted, ChallengeResponse{
+		Success: true,
+		Status:  "challenge",
+		Method:  result.Challenge.Method,
+		Hint:    result.Challenge.Hint,
+	})
+}
+
+// LoginVerify answers the challenge of a login started with LoginPassword.
+func (prov *ProvisioningAPI) LoginVerify(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	if !prov.checkNotLoggedIn(w, user) {
+		return
+	}
+
+	var req VerifyLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Code) == 0 {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "Missing code",
+			ErrCode: "bad request",
+		})
+		return
+	}
+
+	prov.passwordLoginsLock.Lock()
+	login, ok := prov.passwordLogins[user.MXID]
+	if ok && time.Since(login.Started) > passwordLoginTimeout {
+		delete(prov.passwordLogins, user.MXID)
+		ok = false
+	}
+	prov.passwordLoginsLock.Unlock()
+	if !ok {
+		jsonResponse(w, http.StatusBadRequest, Error{
+			Error:   "No login in progress",
+			ErrCode: "no login",
+		})
+		return
+	}
+
+	token, err := login.Client.Verify(r.Context(), login.Challenge, req.Code)
+	if isUnauthorized(err) {
+		jsonResponse(w, http.StatusUnauthorized, Error{
+			Error:   "Incorrect code",
+			ErrCode: "invalid code",
+		})
+		return
+	}
+	prov.passwordLoginsLock.Lock()
+	delete(prov.passwordLogins, user.MXID)
+	prov.passwordLoginsLock.Unlock()
+	if err != nil {
+		prov.log.Warnfln("Failed to verify login of %s: %v", user.MXID, err)
+		jsonResponse(w, http.StatusBadGateway, Error{
+			Error:   "Failed to log in to GroupMe",
+			ErrCode: "groupme error",
+		})
+		return
+	}
+	prov.finishLogin(w, user, token)
+}
+
+func (prov *ProvisioningAPI) finishLogin(w http.ResponseWriter, user *User, token string) {
+	me, err := user.Login(token)
+	if errors.Is(err, ErrAccountInUse) {
+		jsonResponse(w, http.StatusConflict, Error{
+			Error:   err.Error(),
+			ErrCode: "account in use",
+		})
+		return
+	} else if me == nil {
+		if isUnauthorized(err) {
+			jsonResponse(w, http.StatusUnauthorized, Error{
+				Error:   "Invalid access token",
+				ErrCode: "invalid token",
+			})
+		} else {
+			prov.log.Warnfln("Failed to validate access token of %s: %v", user.MXID, err)
+			jsonResponse(w, http.StatusBadGateway, Error{
+				Error:   "Failed to check the access token with GroupMe",
+				ErrCode: "groupme error",
+			})
+		}
+		return
+	} else if err != nil {
+		prov.log.Warnfln("Failed to connect %s after login: %v", user.MXID, err)
+		jsonResponse(w, http.StatusInternalServerError, Error{
+			Error:   "Logged in, but failed to connect to GroupMe",
+			ErrCode: "connection failed",
+		})
+		return
+	}
+	jsonResponse(w, http.StatusOK, LoginResponse{
+		Success: true,
+		GMID:    me.ID,
+		Name:    me.Name,
+		Phone:   string(me.PhoneNumber),
+		Email:   me.Email,
+	})
+}
+
 func jsonResponse(w http.ResponseWriter, status int, response interface{}) {
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(status)
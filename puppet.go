@@ -29,6 +29,7 @@ import (
 	"maunium.net/go/mautrix/bridge"
 	"maunium.net/go/mautrix/id"
 
+	"github.com/beeper/groupme/config"
 	"github.com/beeper/groupme/database"
 )
 
@@ -215,9 +216,9 @@ func (puppet *Puppet) DefaultIntent() *appservice.IntentAPI {
 //
 //}
 
-func (puppet *Puppet) UpdateAvatar(source *User, forcePortalSync bool) bool {
-	changed := source.updateAvatar(puppet.GMID, &puppet.Avatar, &puppet.AvatarURL, &puppet.AvatarSet, puppet.log, puppet.DefaultIntent())
-	if !changed || puppet.Avatar == "unauthorized" {
+func (puppet *Puppet) UpdateAvatar(avatar string, forcePortalSync bool) bool {
+	changed := puppet.bridge.updateAvatar(avatar, &puppet.Avatar, &puppet.AvatarURL, &puppet.AvatarSet, puppet.log, puppet.DefaultIntent())
+	if !changed {
 		if forcePortalSync {
 			go puppet.updatePortalAvatar()
 		}
@@ -228,13 +229,18 @@ func (puppet *Puppet) UpdateAvatar(source *User, forcePortalSync bool) bool {
 		puppet.log.Warnln("Failed to set avatar:", err)
 	} else {
 		puppet.AvatarSet = true
+		go puppet.resyncNicknames()
 	}
 	go puppet.updatePortalAvatar()
 	return true
 }
 
 func (puppet *Puppet) UpdateName(member groupme.Member, forcePortalSync bool) bool {
-	newName := puppet.bridge.Config.Bridge.FormatDisplayname(puppet.GMID, member)
+	newName := puppet.bridge.Config.Bridge.FormatDisplayname(config.DisplaynameTemplateArgs{
+		UserID:   puppet.GMID,
+		Nickname: member.Nickname,
+		ImageURL: member.ImageURL,
+	})
 	if puppet.Displayname != newName || !puppet.NameSet {
 		oldName := puppet.Displayname
 		puppet.Displayname = newName
@@ -244,6 +250,7 @@ func (puppet *Puppet) UpdateName(member groupme.Member, forcePortalSync bool) bo
 			puppet.log.Debugln("Updated name", oldName, "->", newName)
 			puppet.NameSet = true
 			go puppet.updatePortalName()
+			go puppet.resyncNicknames()
 		} else {
 			puppet.log.Warnln("Failed to set display name:", err)
 		}
@@ -303,7 +310,22 @@ func (puppet *Puppet) Sync(source *User, member *groupme.Member, forceAvatarSync
 		puppet.log.Errorln("Failed to ensure registered:", err)
 	}
 
-	puppet.log.Debugfln("Syncing info through %s", source.GMID)
+	if source != nil {
+		puppet.log.Debugfln("Syncing info through %s", source.GMID)
+	}
 
-	// TODO
+	if member == nil {
+		return
+	}
+	update := false
+	if len(member.Nickname) > 0 {
+		update = puppet.UpdateName(*member, forcePortalSync) || update
+	}
+	if forceAvatarSync {
+		puppet.AvatarSet = false
+	}
+	update = puppet.UpdateAvatar(member.ImageURL, forcePortalSync) || update
+	if update {
+		puppet.Update()
+	}
 }
@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -30,6 +31,7 @@ import (
 	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/bridge"
 	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/bridge/commands"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/format"
 	"maunium.net/go/mautrix/id"
@@ -42,7 +44,11 @@ import (
 
 type User struct {
 	*database.User
-	Conn *groupme.PushSubscription
+	// Conn and faye make up the push connection. They're replaced when
+	// reconnecting, so use getConnection instead of reading them directly.
+	Conn     *groupme.PushSubscription
+	faye     *groupmeext.FayeClient
+	connLock sync.RWMutex
 
 	bridge *GMBridge
 	log    log.Logger
@@ -57,7 +63,7 @@ type User struct {
 	ConnectionErrors int
 	CommunityID      string
 
-	ChatList     map[groupme.ID]groupme.Chat
+	ChatList     map[groupme.ID]groupmeext.Chat
 	GroupList    map[groupme.ID]groupme.Group
 	RelationList map[groupme.ID]groupme.User
 
@@ -72,9 +78,12 @@ type User struct {
 	messageOutput chan PortalMessage
 
 	mgmtCreateLock sync.Mutex
+	catchUpLock    sync.Mutex
 
 	spaceCreateLock        sync.Mutex
 	spaceMembershipChecked bool
+
+	commandState *commands.CommandState
 }
 
 func (br *GMBridge) getUserByMXID(userID id.UserID, onlyIfExists bool) *User {
@@ -119,8 +128,12 @@ func (user *User) GetMXID() id.UserID {
 	return user.MXID
 }
 
-func (user *User) GetCommandState() map[string]interface{} {
-	return nil
+func (user *User) GetCommandState() *commands.CommandState {
+	return user.commandState
+}
+
+func (user *User) SetCommandState(state *commands.CommandState) {
+	user.commandState = state
 }
 
 func (br *GMBridge) GetUserByMXIDIfExists(userID id.UserID) *User {
@@ -329,11 +342,22 @@ func (user *User) SetManagementRoom(roomID id.RoomID) {
 	user.Update()
 }
 
+// getConnection returns the current push connection, which is nil if the user
+// isn't connected.
+func (user *User) getConnection() (*groupme.PushSubscription, *groupmeext.FayeClient) {
+	user.connLock.RLock()
+	defer user.connLock.RUnlock()
+	return user.Conn, user.faye
+}
+
 func (user *User) Connect() bool {
+	if len(user.Token) == 0 {
+		return false
+	}
+	user.connLock.Lock()
 	if user.Conn != nil {
+		user.connLock.Unlock()
 		return true
-	} else if len(user.Token) == 0 {
-		return false
 	}
 
 	user.log.Debugfln("Connecting to GroupMe")
@@ -342,25 +366,37 @@ func (user *User) Connect() bool {
 		timeout = 20
 	}
 	conn := groupme.NewPushSubscription(context.Background())
+	faye := groupmeext.NewFayeClient(user.log, user.Token)
+	conn.StartListening(context.Background(), faye)
+	conn.AddFullHandler(user)
+	faye.AddReadHandler(user)
+	faye.AddReconnectHandler(user)
 	user.Conn = &conn
-	user.Conn.StartListening(context.Background(), groupmeext.NewFayeClient(user.log))
-	user.Conn.AddFullHandler(user)
+	user.faye = faye
+	user.connLock.Unlock()
 
-	//TODO: typing notification?
 	return user.RestoreSession()
 }
 
 func (user *User) RestoreSession() bool {
 	if len(user.Token) > 0 {
-		err := user.Conn.SubscribeToUser(context.TODO(), groupme.ID(user.GMID), user.Token)
-		if err != nil {
-			fmt.Println(err)
+		if conn, _ := user.getConnection(); conn != nil {
+			err := conn.SubscribeToUser(context.TODO(), groupme.ID(user.GMID), user.Token)
+			if err != nil {
+				fmt.Println(err)
+			}
 		}
 		//TODO: typing notifics
+		user.Client = groupmeext.NewClient(user.Token)
 		user.ConnectionErrors = 0
 		//user.SetSession(&sess)
 		user.log.Debugln("Session restored successfully")
 		user.PostLogin()
+		go func() {
+			user.HandleChatList()
+			user.syncPortals(false)
+			user.CatchUp()
+		}()
 		return true
 	} else {
 		user.log.Debugln("tried login but no token")
@@ -374,11 +410,12 @@ func (user *User) HasSession() bool {
 
 func (user *User) IsConnected() bool {
 	// TODO: better connection check
-	return user.Conn != nil
+	conn, _ := user.getConnection()
+	return conn != nil
 }
 
 func (user *User) IsLoggedIn() bool {
-	return true
+	return user.Client != nil
 }
 
 func (user *User) IsLoginInProgress() bool {
@@ -386,6 +423,16 @@ func (user *User) IsLoginInProgress() bool {
 	return false
 }
 
+// ReceiptsEnabled returns whether the user's Matrix read receipts should be
+// bridged to GroupMe. It can be toggled for users with double puppeting.
+func (user *User) ReceiptsEnabled() bool {
+	puppet := user.bridge.GetPuppetByCustomMXID(user.MXID)
+	if puppet != nil {
+		return puppet.EnableReceipts
+	}
+	return user.bridge.Config.Bridge.DefaultBridgeReceipts
+}
+
 func (user *User) GetGMID() groupme.ID {
 	if len(user.GMID) == 0 {
 		u, err := user.Client.MyUser(context.TODO())
@@ -398,15 +445,143 @@ func (user *User) GetGMID() groupme.ID {
 	return user.GMID
 }
 
-func (user *User) Login(token string) error {
+var ErrAccountInUse = errors.New("that GroupMe account is already logged in to another Matrix user")
+
+// Login checks that the access token works and connects with it. The token is
+// only saved if it's valid and its account isn't used by another Matrix user.
+func (user *User) Login(token string) (*groupme.User, error) {
+	me, err := user.newLoginClient().CheckToken(context.TODO(), token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to validate access token: %w", err)
+	}
+
+	user.bridge.usersLock.Lock()
+	existing, ok := user.bridge.usersByGMID[me.ID]
+	if ok && existing.MXID != user.MXID {
+		user.bridge.usersLock.Unlock()
+		return nil, ErrAccountInUse
+	} else if dbUser := user.bridge.DB.User.GetByGMID(me.ID); dbUser != nil && dbUser.MXID != user.MXID {
+		user.bridge.usersLock.Unlock()
+		return nil, ErrAccountInUse
+	}
+	if len(user.GMID) > 0 && user.GMID != me.ID {
+		delete(user.bridge.usersByGMID, user.GMID)
+	}
 	user.Token = token
+	user.GMID = me.ID
+	user.Update()
+	user.bridge.usersByGMID[user.GMID] = user
+	user.bridge.usersLock.Unlock()
 
-	user.addToGMIDMap()
-	user.PostLogin()
-	if user.Connect() {
-		return nil
+	if !user.Connect() {
+		return me, errors.New("failed to connect")
+	}
+	return me, nil
+}
+
+// Disconnect closes the push connection. The session is kept, so the GroupMe
+// API can still be used and Connect reconnects later.
+func (user *User) Disconnect() {
+	user.connLock.Lock()
+	conn, faye := user.Conn, user.faye
+	user.Conn = nil
+	user.faye = nil
+	user.connLock.Unlock()
+	if conn == nil {
+		return
+	}
+	user.log.Debugln("Disconnecting from GroupMe")
+	// Closing can take a moment, as it tells the push server that the client
+	// is going away, so it's done without holding the lock
+	if faye != nil {
+		faye.Close()
+	}
+	user.bridge.Metrics.TrackConnectionState(user.GMID, false)
+}
+
+// Reconnect replaces the push connection with a new one. Connecting catches
+// up on the messages that were sent while the connection was down.
+func (user *User) Reconnect() bool {
+	user.Disconnect()
+	return user.Connect()
+}
+
+// DeleteSession disconnects and forgets the GroupMe token, without touching
+// portals or double puppeting.
+func (user *User) DeleteSession() {
+	user.Disconnect()
+	user.removeFromGMIDMap()
+	user.Client = nil
+	user.ChatList = nil
+	user.GroupList = nil
+	user.RelationList = nil
+	user.Token = ""
+	user.GMID = ""
+	user.Update()
+	user.bridge.DB.Backfill.DeleteAllForUser(user.MXID)
+}
+
+// Logout deletes the session and disables double puppeting. If cleanPortals
+// is set, the user is also kicked from their group portals, and their private
+// chat portals and the group portals nobody else is in are deleted.
+func (user *User) Logout(cleanPortals bool) {
+	if len(user.GMID) > 0 {
+		if cleanPortals {
+			// Done first so that m.direct is still updated with double puppeting
+			user.cleanupPortals()
+		}
+		puppet := user.bridge.GetPuppetByGMID(user.GMID)
+		if puppet != nil && puppet.CustomMXID == user.MXID {
+			err := puppet.SwitchCustomMXID("", "")
+			if err != nil {
+				user.log.Warnln("Failed to disable double puppeting while logging out:", err)
+			}
+		}
+	}
+	user.DeleteSession()
+}
+
+func (user *User) cleanupPortals() {
+	for _, portal := range user.bridge.GetAllPortals() {
+		if len(portal.MXID) == 0 {
+			continue
+		} else if portal.IsPrivateChat() {
+			if portal.Key.Receiver == user.GMID {
+				portal.Delete()
+				portal.Cleanup(false)
+			}
+			continue
+		} else if _, ok := user.GroupList[portal.Key.GMID]; !ok {
+			continue
+		}
+		_, err := portal.MainIntent().KickUser(portal.MXID, &mautrix.ReqKickUser{UserID: user.MXID, Reason: "Logged out of GroupMe"})
+		if err != nil {
+			portal.log.Warnfln("Failed to kick %s after logout: %v", user.MXID, err)
+		}
+		portal.CleanupIfEmpty()
+	}
+	user.UpdateDirectChats(nil)
+}
+
+// PasswordLogin is a login with a username and password that's in progress,
+// either waiting for the password or for the answer to a challenge.
+type PasswordLogin struct {
+	Client    *groupmeext.LoginClient
+	Username  string
+	Challenge *groupmeext.LoginChallenge
+	Started   time.Time
+}
+
+func (user *User) NewPasswordLogin() *PasswordLogin {
+	return &PasswordLogin{
+		Client:  user.newLoginClient(),
+		Started: time.Now(),
 	}
-	return errors.New("failed to connect")
+}
+
+func (user *User) newLoginClient() *groupmeext.LoginClient {
+	cfg := user.bridge.Config.GroupMe
+	return groupmeext.NewLoginClient(cfg.LoginBaseURL, cfg.APIBaseURL)
 }
 
 type Chat struct {
@@ -555,7 +730,7 @@ func (user *User) HandleChatList() {
 	}
 	user.GroupList = chatMap
 
-	dmMap := map[groupme.ID]groupme.Chat{}
+	dmMap := map[groupme.ID]groupmeext.Chat{}
 	dms, err := user.Client.IndexAllChats()
 	if err != nil {
 		user.log.Errorln("chat sync error", err) //TODO: handle
@@ -563,6 +738,14 @@ func (user *User) HandleChatList() {
 	}
 	for _, dm := range dms {
 		dmMap[dm.OtherUser.ID] = *dm
+		user.bridge.GetPuppetByGMID(dm.OtherUser.ID).Sync(user, &groupme.Member{
+			UserID:   dm.OtherUser.ID,
+			Nickname: dm.OtherUser.Name,
+			ImageURL: dm.OtherUser.AvatarURL,
+		}, false, false)
+		if dm.ReadReceipt != nil {
+			user.HandleRead(*dm.ReadReceipt)
+		}
 	}
 	user.ChatList = dmMap
 
@@ -584,88 +767,42 @@ func (user *User) HandleChatList() {
 	user.RelationList = userMap
 
 	user.log.Infoln("Chat list received")
-	user.chatListReceived <- struct{}{}
-	go user.syncPortals(false)
+	select {
+	case user.chatListReceived <- struct{}{}:
+	default:
+	}
 }
 
+// syncPortals creates portals for the user's recent direct chats and makes
+// sure the user is in the existing ones. Group portals are created when
+// messages are received.
 func (user *User) syncPortals(createAll bool) {
-	//	user.log.Infoln("Reading chat list")
-
-	//	chats := make(ChatList, 0, len(user.GroupList)+len(user.ChatList))
-	//	portalKeys := make([]database.PortalKeyWithMeta, 0, cap(chats))
-
-	//	for _, group := range user.GroupList {
-
-	//		portal := user.bridge.GetPortalByJID(database.GroupPortalKey(group.ID.String()))
-
-	//		chats = append(chats, Chat{
-	//			Portal:          portal,
-	//			LastMessageTime: uint64(group.UpdatedAt.ToTime().Unix()),
-	//			Group:           &group,
-	//		})
-	//	}
-	//	for _, dm := range user.ChatList {
-	//		portal := user.bridge.GetPortalByJID(database.NewPortalKey(dm.OtherUser.ID.String(), user.JID))
-	//		chats = append(chats, Chat{
-	//			Portal:          portal,
-	//			LastMessageTime: uint64(dm.UpdatedAt.ToTime().Unix()),
-	//			DM:              &dm,
-	//		})
-	//	}
-
-	//	for _, chat := range chats {
-	//		var inCommunity, ok bool
-	//		if inCommunity, ok = existingKeys[chat.Portal.Key]; !ok || !inCommunity {
-	//			inCommunity = user.addPortalToCommunity(chat.Portal)
-	//			if chat.Portal.IsPrivateChat() {
-	//				puppet := user.bridge.GetPuppetByJID(chat.Portal.Key.GMID)
-	//				user.addPuppetToCommunity(puppet)
-	//			}
-	//		}
-	//		portalKeys = append(portalKeys, database.PortalKeyWithMeta{PortalKey: chat.Portal.Key, InCommunity: inCommunity})
-	//	}
-	//	user.log.Infoln("Read chat list, updating user-portal mapping")
-
-	//	err := user.SetPortalKeys(portalKeys)
-	//	if err != nil {
-	//		user.log.Warnln("Failed to update user-portal mapping:", err)
-	//	}
-	//	sort.Sort(chats)
-	//	limit := user.bridge.Config.Bridge.InitialChatSync
-	//	if limit < 0 {
-	//		limit = len(chats)
-	//	}
-	//	now := uint64(time.Now().Unix())
-	//	user.log.Infoln("Syncing portals")
-
-	//	wg := sync.WaitGroup{}
-	//	for i, chat := range chats {
-	//		if chat.LastMessageTime+user.bridge.Config.Bridge.SyncChatMaxAge < now {
-	//			break
-	//		}
-	//		wg.Add(1)
-	//		go func(chat Chat, i int) {
-	//			create := (chat.LastMessageTime >= user.LastConnection && user.LastConnection > 0) || i < limit
-	//			if len(chat.Portal.MXID) > 0 || create || createAll {
-	//				chat.Portal.Sync(user, chat.Group)
-	//				err := chat.Portal.BackfillHistory(user, chat.LastMessageTime)
-	//				if err != nil {
-	//					chat.Portal.log.Errorln("Error backfilling history:", err)
-	//				}
-	//			}
-
-	//			wg.Done()
-	//		}(chat, i)
-
-	// }
-	// wg.Wait()
-	// //TODO: handle leave from groupme side
-	// user.UpdateDirectChats(nil)
-	// user.log.Infoln("Finished syncing portals")
-	// select {
-	// case user.syncPortalsDone <- struct{}{}:
-	// default:
-	// }
+	chats := make(ChatList, 0, len(user.ChatList))
+	for _, dm := range user.ChatList {
+		dm := dm.Chat
+		chats = append(chats, Chat{
+			Portal:          user.GetPortalByGMID(dm.OtherUser.ID),
+			LastMessageTime: uint64(dm.UpdatedAt.ToTime().Unix()),
+			DM:              &dm,
+		})
+	}
+	sort.Sort(chats)
+	limit := user.bridge.Config.Bridge.InitialChatSync
+	if limit < 0 || createAll {
+		limit = len(chats)
+	}
+	now := uint64(time.Now().Unix())
+	user.log.Infoln("Syncing direct chat portals")
+	for i, chat := range chats {
+		if len(chat.Portal.MXID) == 0 {
+			if i >= limit || (!createAll && chat.LastMessageTime+uint64(user.bridge.Config.Bridge.SyncMaxChatAge) < now) {
+				continue
+			}
+		}
+		chat.Portal.Sync(user, nil)
+	}
+	user.UpdateDirectChats(nil)
+	user.log.Infoln("Finished syncing direct chat portals")
 }
 
 func (user *User) getDirectChats() map[id.UserID][]id.RoomID {
@@ -745,6 +882,59 @@ func (user *User) GetPortalByGMID(gmid groupme.ID) *Portal {
 	return user.bridge.GetPortalByGMID(user.PortalKey(gmid))
 }
 
+// CanMessage checks if the user can start a direct chat with the given
+// GroupMe user, which requires an existing chat, the user being a contact or
+// a shared group.
+func (user *User) CanMessage(gmid groupme.ID) bool {
+	if gmid == user.GMID {
+		return false
+	} else if _, ok := user.ChatList[gmid]; ok {
+		return true
+	} else if _, ok = user.RelationList[gmid]; ok {
+		return true
+	}
+	for _, group := range user.GroupList {
+		for _, member := range group.Members {
+			if member.UserID == gmid {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Contacts returns the GroupMe users that the user can message, from the
+// user's direct chats, contacts and groups.
+func (user *User) Contacts() map[groupme.ID]groupme.Member {
+	contacts := make(map[groupme.ID]groupme.Member)
+	for _, group := range user.GroupList {
+		for _, member := range group.Members {
+			contacts[member.UserID] = *member
+		}
+	}
+	for gmid, relation := range user.RelationList {
+		contacts[gmid] = groupme.Member{UserID: gmid, Nickname: relation.Name, ImageURL: relation.AvatarURL}
+	}
+	for gmid, chat := range user.ChatList {
+		contacts[gmid] = groupme.Member{UserID: gmid, Nickname: chat.OtherUser.Name, ImageURL: chat.OtherUser.AvatarURL}
+	}
+	delete(contacts, user.GMID)
+	return contacts
+}
+
+// SearchContacts finds the contacts whose name contains the query, ignoring
+// case.
+func (user *User) SearchContacts(query string) map[groupme.ID]groupme.Member {
+	query = strings.ToLower(query)
+	results := make(map[groupme.ID]groupme.Member)
+	for gmid, contact := range user.Contacts() {
+		if strings.Contains(strings.ToLower(contact.Nickname), query) {
+			results[gmid] = contact
+		}
+	}
+	return results
+}
+
 func (user *User) runMessageRingBuffer() {
 	for msg := range user.messageInput {
 		select {
@@ -763,32 +953,68 @@ func (user *User) handleMessageLoop() {
 		select {
 		case msg := <-user.messageOutput:
 			user.bridge.Metrics.TrackBufferLength(user.MXID, len(user.messageOutput))
-			puppet := user.bridge.GetPuppetByGMID(msg.data.UserID)
-			portal := user.bridge.GetPortalByGMID(msg.chat)
-			if puppet != nil {
-				puppet.Sync(user, &groupme.Member{
-					UserID:   msg.data.UserID,
-					Nickname: msg.data.Name,
-					ImageURL: msg.data.AvatarURL,
-				}, false, false)
-			}
-			portal.messages <- msg
+			user.queuePortalMessage(user.bridge.GetPortalByGMID(msg.chat), msg)
 		}
 	}
 }
 
-func (user *User) HandleTextMessage(message groupme.Message) {
-	id := database.ParsePortalKey(message.GroupID.String())
+// queuePortalMessage syncs the info of the sender of a message and passes the
+// message on to the portal.
+func (user *User) queuePortalMessage(portal *Portal, msg PortalMessage) {
+	puppet := user.bridge.GetPuppetByGMID(msg.data.UserID)
+	if puppet != nil {
+		portal.syncMember(user, puppet, groupme.Member{
+			UserID:   msg.data.UserID,
+			Nickname: msg.data.Name,
+			ImageURL: msg.data.AvatarURL,
+		})
+		puppet.UpdateNickname(portal, msg.data.Name)
+	}
+	portal.messages <- msg
+}
 
-	if id == nil {
-		id = database.ParsePortalKey(message.ConversationID.String())
+// directChatPortalKey finds the portal of a direct message conversation ID,
+// which consists of the IDs of both users.
+func (user *User) directChatPortalKey(conversationID groupme.ID) *database.PortalKey {
+	parts := strings.Split(conversationID.String(), "+")
+	if len(parts) != 2 {
+		return nil
+	}
+	other := groupme.ID(parts[0])
+	if other == user.GMID {
+		other = groupme.ID(parts[1])
+	}
+	key := user.PortalKey(other)
+	return &key
+}
+
+func (user *User) HandleTextMessage(message groupme.Message) {
+	var id *database.PortalKey
+	if len(message.GroupID) > 0 {
+		id = database.ParsePortalKey(message.GroupID.String())
+	} else {
+		id = user.directChatPortalKey(message.ConversationID)
 	}
 	if id == nil {
 		user.log.Errorln("Error parsing conversationid/portalkey", message.ConversationID.String(), "ignoring message")
 		return
 	}
 
-	user.messageInput <- PortalMessage{*id, user, &message, uint64(message.CreatedAt.ToTime().Unix())}
+	user.messageInput <- PortalMessage{chat: *id, source: user, data: &message, timestamp: uint64(message.CreatedAt.ToTime().Unix())}
+}
+
+func (user *User) HandleRead(receipt groupmeext.ReadReceipt) {
+	if receipt.UserID == user.GMID {
+		return
+	}
+	portal := user.bridge.GetExistingPortalByGMID(user.PortalKey(receipt.UserID))
+	if portal != nil {
+		portal.HandleGroupMeReadReceipt(receipt)
+	}
+}
+
+func (user *User) HandleReconnect() {
+	user.CatchUp()
 }
 
 func (user *User) HandleLike(msg groupme.Message) {
@@ -829,17 +1055,17 @@ func (user *User) HandleLikeIcon(_ groupme.ID, _, _ int, _ string) {
 
 func (user *User) HandleNewNickname(groupID, userID groupme.ID, name string) {
 	puppet := user.bridge.GetPuppetByGMID(userID)
-	if puppet != nil {
-		puppet.UpdateName(groupme.Member{
-			Nickname: name,
-			UserID:   userID,
-		}, false)
+	portal := user.bridge.GetExistingPortalByGMID(database.GroupPortalKey(groupID))
+	if puppet != nil && portal != nil {
+		puppet.UpdateNickname(portal, name)
 	}
 }
 
 func (user *User) HandleNewAvatarInGroup(groupID, userID groupme.ID, url string) {
 	puppet := user.bridge.GetPuppetByGMID(userID)
-	puppet.UpdateAvatar(user, false)
+	if puppet != nil && puppet.UpdateAvatar(url, false) {
+		puppet.Update()
+	}
 }
 
 func (user *User) HandleMembers(_ groupme.ID, _ []groupme.Member, _ bool) {